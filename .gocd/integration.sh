@@ -41,8 +41,8 @@ make testclean clean TAG=${TAG}
 
 # make the plugin
 make TAG=${TAG}
-# enable the plugin
-make enable TAG=${TAG}
+# enable the plugin with a secret key to seal the volume secrets
+make enable TAG=${TAG} SECRET_KEY="$(head -c 32 /dev/urandom | base64)"
 
 # start sshd
 docker run -d -p ${MOUNT_PORT}:22 --name ${SSH_MOUNT_CONTAINER} ${DOCKER_SSH_MOUNT_IMAGE}
@@ -49,8 +49,8 @@ fi
 
 # make the plugin
 make TAG="${TAG}"
-# enable the plugin
-make enable TAG="${TAG}"
+# enable the plugin with a secret key to seal the volume secrets
+make enable TAG="${TAG}" SECRET_KEY="$(head -c 32 /dev/urandom | base64)"
 
 # start sshd
 docker run -d -p ${MOUNT_PORT}:22 -v ${TEST_SSH_PUB_KEY_PATH}:/authorized-keys/${TEST_SSH_KEY_NAME}.pub --name ${SSH_MOUNT_CONTAINER} ${DOCKER_SSH_MOUNT_IMAGE}
@@ -11,4 +11,4 @@ go get -u golang.org/x/lint/golint
 test -z "$(go vet ./... | grep -v vendor/ | tee /dev/stderr)"
 test -z "$(golint ./... | grep -v vendor/ | tee /dev/stderr)"
 #test -z "$(gofmt -s -l . | grep -v vendor/ | tee /dev/stderr)"
-go list ./... | go test -v
\ No newline at end of file
+go test -v -race ./...
\ No newline at end of file
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CapacityTimeout bounds querying the capacity of a mounted volume,
+	// whose filesystem might hang when the server stopped responding
+	CapacityTimeout = 5 * time.Second
+	// CapacityCacheTTL sets how long the capacity of an unmounted volume is
+	// reported before the server is queried again
+	CapacityCacheTTL = time.Minute
+)
+
+// capacity is the size and usage of the remote filesystem of a volume
+type capacity struct {
+	TotalBytes  uint64
+	UsedBytes   uint64
+	FreeBytes   uint64
+	TotalInodes uint64
+	UsedInodes  uint64
+	FreeInodes  uint64
+}
+
+// newCapacity converts the statvfs fields, where the free bytes and
+// inodes are those that are available to the volume's user
+func newCapacity(frsize, blocks, bfree, bavail, files, ffree, favail uint64) capacity {
+	return capacity{
+		TotalBytes:  blocks * frsize,
+		UsedBytes:   (blocks - bfree) * frsize,
+		FreeBytes:   bavail * frsize,
+		TotalInodes: files,
+		UsedInodes:  files - ffree,
+		FreeInodes:  favail,
+	}
+}
+
+// cachedCapacity is the capacity status of an unmounted volume
+// and when it was queried
+type cachedCapacity struct {
+	status map[string]interface{}
+	at     time.Time
+}
+
+func (c capacity) status() map[string]interface{} {
+	return map[string]interface{}{
+		"capacity_total_bytes":  c.TotalBytes,
+		"capacity_used_bytes":   c.UsedBytes,
+		"capacity_free_bytes":   c.FreeBytes,
+		"capacity_total_inodes": c.TotalInodes,
+		"capacity_used_inodes":  c.UsedInodes,
+		"capacity_free_inodes":  c.FreeInodes,
+	}
+}
+
+// statfsCapacity returns the capacity of the filesystem mounted at the path.
+// It blocks for as long as the filesystem doesn't respond.
+func statfsCapacity(mountPoint string) (capacity, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return capacity{}, fmt.Errorf("failed to query the capacity of %s (%s)", mountPoint, err)
+	}
+	frsize := uint64(stat.Frsize)
+	if frsize == 0 {
+		frsize = uint64(stat.Bsize)
+	}
+	// Linux doesn't report the inodes available to unprivileged users
+	return newCapacity(frsize, stat.Blocks, stat.Bfree, stat.Bavail,
+		stat.Files, stat.Ffree, stat.Ffree), nil
+}
+
+// sftpCapacity connects to the server and queries the capacity of the
+// volume's remote path with the statvfs@openssh.com extension by the deadline
+func (v *sshfsVolume) sftpCapacity(deadline time.Time) (capacity, error) {
+	sshClient, err := v.dialSSHBefore(deadline)
+	if err != nil {
+		return capacity{}, err
+	}
+	defer sshClient.Close()
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return capacity{}, fmt.Errorf("failed to start the sftp session (%s)", err)
+	}
+	defer sftpClient.Close()
+
+	root, err := v.resolveRemotePath(sftpClient)
+	if err != nil {
+		return capacity{}, err
+	}
+	stat, err := sftpClient.StatVFS(root)
+	if err != nil {
+		return capacity{}, fmt.Errorf("failed to query the capacity of the remote path %s (%s)", root, err)
+	}
+	return newCapacity(stat.Frsize, stat.Blocks, stat.Bfree, stat.Bavail,
+		stat.Files, stat.Ffree, stat.Favail), nil
+}
+
+// capacityQuery is a capacity query of a volume that is in flight
+type capacityQuery struct {
+	started time.Time
+	done    chan struct{}
+	status  map[string]interface{}
+}
+
+// capacityStatus returns the capacity of the volume for its status.
+// Mounted volumes are queried through their mountpoint, and other volumes
+// over sftp at most once per CapacityCacheTTL. Each volume has at most one
+// query in flight, which the callers share and wait for up to CapacityTimeout,
+// such that a hung mount or server doesn't pile up queries.
+// It doesn't take vol.lock, and the caller must not hold d.mutex.
+func (d *sshfsDriver) capacityStatus(vol *sshfsVolume) map[string]interface{} {
+	d.mutex.Lock()
+	snapshot := d.snapshot(vol)
+	if cached := snapshot.capacity; snapshot.ConnectedAt == "" && cached != nil && time.Since(cached.at) < CapacityCacheTTL {
+		d.mutex.Unlock()
+		return cached.status
+	}
+	query, ok := d.capacityQueries[vol]
+	if !ok {
+		query = &capacityQuery{started: time.Now(), done: make(chan struct{})}
+		d.capacityQueries[vol] = query
+		go d.queryCapacity(vol, snapshot, query)
+	}
+	d.mutex.Unlock()
+
+	timer := time.NewTimer(CapacityTimeout - time.Since(query.started))
+	defer timer.Stop()
+	select {
+	case <-query.done:
+		return query.status
+	case <-timer.C:
+		msg := fmt.Sprintf("querying the capacity of volume %s timed out after %s", vol.Name, CapacityTimeout)
+		return map[string]interface{}{"capacity_error": msg}
+	}
+}
+
+// queryCapacity runs the capacity query of the volume from its snapshot
+func (d *sshfsDriver) queryCapacity(vol *sshfsVolume, snapshot *sshfsVolume, query *capacityQuery) {
+	var c capacity
+	var err error
+	mounted := snapshot.ConnectedAt != ""
+	if mounted {
+		c, err = statfsCapacity(snapshot.MountPoint)
+	} else if snapshot.keyShredded() {
+		err = fmt.Errorf("the ephemeral key of the volume has been shredded")
+	} else {
+		// New host keys are accepted by mounts, not by the status
+		if snapshot.StrictHostKeyChecking == StrictHostKeyCheckingAcceptNew {
+			snapshot.StrictHostKeyChecking = StrictHostKeyCheckingYes
+		}
+		c, err = snapshot.sftpCapacity(query.started.Add(CapacityTimeout))
+	}
+	status := c.status()
+	if err != nil {
+		status = map[string]interface{}{"capacity_error": err.Error()}
+	}
+
+	d.mutex.Lock()
+	query.status = status
+	delete(d.capacityQueries, vol)
+	if !mounted {
+		vol.capacity = &cachedCapacity{status: status, at: time.Now()}
+	}
+	d.mutex.Unlock()
+	close(query.done)
+}
+
+// parseMinFree parses the min_free option, which is either a size in bytes
+// with an optional K, M, G or T suffix, or a percentage of the total size
+func parseMinFree(val string) (bytes uint64, percent float64, err error) {
+	raw := strings.TrimSpace(val)
+	if strings.HasSuffix(raw, "%") {
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return 0, 0, fmt.Errorf("invalid 'min_free' option '%s', a percentage must be between 0 and 100", val)
+		}
+		return 0, percent, nil
+	}
+
+	unit := uint64(1)
+	upper := strings.ToUpper(raw)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(upper, suffix) || strings.HasSuffix(upper, suffix+"B") {
+			unit = 1 << (10 * uint(i+1))
+			upper = strings.TrimSuffix(strings.TrimSuffix(upper, "B"), suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseUint(upper, 10, 64)
+	if err != nil || size == 0 {
+		return 0, 0, fmt.Errorf("invalid 'min_free' option '%s', it must be a size such as 10G or a percentage such as 5%%", val)
+	}
+	return size * unit, 0, nil
+}
+
+// checkMinFree returns an error if the remote filesystem has less free
+// space than the volume's min_free option requires
+func (v *sshfsVolume) checkMinFree(c capacity) error {
+	bytes, percent, err := parseMinFree(v.MinFree)
+	if err != nil {
+		return err
+	}
+	required := bytes
+	if percent > 0 {
+		required = uint64(float64(c.TotalBytes) * percent / 100)
+	}
+	if c.FreeBytes < required {
+		return fmt.Errorf("the remote filesystem has %d bytes free, less than the min_free of %s", c.FreeBytes, v.MinFree)
+	}
+	return nil
+}
+
+// checkCapacity fails the mount of a volume whose remote filesystem has
+// less free space than its min_free option. The mount proceeds if the
+// capacity can't be queried, such as when the server lacks the extension.
+func (d *sshfsDriver) checkCapacity(mount *sshfsVolume) error {
+	c, err := mount.sftpCapacity(mount.deadline(d.mountTimeout))
+	if err != nil {
+		log.Warningf("Mounting volume %s without checking its min_free (%s)", mount.Name, err)
+		return nil
+	}
+	if err := mount.checkMinFree(c); err != nil {
+		msg := fmt.Sprintf("Not mounting volume %s, %s", mount.Name, err)
+		log.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	return nil
+}
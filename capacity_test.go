@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestParseMinFree(t *testing.T) {
+	for val, expected := range map[string]uint64{
+		"1024": 1024,
+		"10K":  10 << 10,
+		"5m":   5 << 20,
+		"2GB":  2 << 30,
+		"1T":   1 << 40,
+	} {
+		bytes, percent, err := parseMinFree(val)
+		if err != nil || bytes != expected || percent != 0 {
+			t.Errorf("Expected %s to be %d bytes, got %d (%v)", val, expected, bytes, err)
+		}
+	}
+	if _, percent, err := parseMinFree("5%"); err != nil || percent != 5 {
+		t.Fatalf("Expected 5 percent, got %f (%v)", percent, err)
+	}
+	for _, val := range []string{"", "0", "-1G", "10X", "0%", "100%", "lots"} {
+		if _, _, err := parseMinFree(val); err == nil {
+			t.Errorf("Expected the min_free %q to be rejected", val)
+		}
+	}
+
+	c := capacity{TotalBytes: 1000, FreeBytes: 40}
+	if err := (&sshfsVolume{MinFree: "5%"}).checkMinFree(c); err == nil {
+		t.Fatal("Expected 4% free to be less than 5%")
+	}
+	if err := (&sshfsVolume{MinFree: "40"}).checkMinFree(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatfsCapacity(t *testing.T) {
+	c, err := statfsCapacity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TotalBytes == 0 || c.FreeBytes > c.TotalBytes || c.UsedBytes > c.TotalBytes {
+		t.Fatalf("Unexpected capacity %+v", c)
+	}
+	if _, err := statfsCapacity(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("Expected an error for a missing path")
+	}
+}
+
+func TestCapacityStatus(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":   "user@" + host + ":" + t.TempDir(),
+		"port":     port,
+		"password": "secret",
+	})
+
+	// An unmounted volume is queried over sftp
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total, ok := res.Volume.Status["capacity_total_bytes"].(uint64); !ok || total == 0 {
+		t.Fatalf("Expected the capacity in the status, got %v", res.Volume.Status)
+	}
+
+	// The capacity of an unmounted volume is cached
+	vol := d.volumes["vol"]
+	vol.capacity.status = map[string]interface{}{"capacity_total_bytes": uint64(1)}
+	if res, err = d.Get(&volume.GetRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["capacity_total_bytes"] != uint64(1) {
+		t.Fatalf("Expected the cached capacity, got %v", res.Volume.Status)
+	}
+	vol.capacity.at = time.Now().Add(-CapacityCacheTTL)
+	if res, err = d.Get(&volume.GetRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["capacity_total_bytes"] == uint64(1) {
+		t.Fatal("Expected an expired capacity to be queried again")
+	}
+
+	// The capacity is queried while a mount or unmount holds the volume's lock
+	vol.lock.Lock()
+	vol.capacity.at = time.Now().Add(-CapacityCacheTTL)
+	res, err = d.Get(&volume.GetRequest{Name: "vol"})
+	vol.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total, ok := res.Volume.Status["capacity_total_bytes"].(uint64); !ok || total <= 1 {
+		t.Fatalf("Expected the capacity of a locked volume, got %v", res.Volume.Status)
+	}
+
+	// A mounted volume is queried through its mountpoint
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = d.Get(&volume.GetRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Volume.Status["capacity_free_inodes"]; !ok {
+		t.Fatalf("Expected the capacity in the status, got %v", res.Volume.Status)
+	}
+
+	createTestVolume(t, d, "unreachable", map[string]string{"sshcmd": "user@127.0.0.1:/data", "port": "1", "password": "pw"})
+	if res, err = d.Get(&volume.GetRequest{Name: "unreachable"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Volume.Status["capacity_error"]; !ok {
+		t.Fatalf("Expected the capacity error in the status, got %v", res.Volume.Status)
+	}
+}
+
+func TestMountMinFree(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	remote := t.TempDir()
+	createTestVolume(t, d, "full", map[string]string{
+		"sshcmd":   "user@" + host + ":" + remote,
+		"port":     port,
+		"password": "secret",
+		"min_free": "1048576T",
+	})
+	_, err := d.Mount(&volume.MountRequest{Name: "full", ID: "c1"})
+	if err == nil || !strings.Contains(err.Error(), "min_free") {
+		t.Fatalf("Expected the mount to fail on min_free, got %v", err)
+	}
+	if mounter.isMounted("full") {
+		t.Fatal("Expected the volume not to be mounted")
+	}
+	if reason := mountFailureReason(err); reason != "capacity" {
+		t.Fatalf("Expected the capacity failure reason, got %s", reason)
+	}
+
+	createTestVolume(t, d, "free", map[string]string{
+		"sshcmd":   "user@" + host + ":" + remote,
+		"port":     port,
+		"password": "secret",
+		"min_free": "1K",
+	})
+	if _, err := d.Mount(&volume.MountRequest{Name: "free", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapacityStatusDoesNotAcceptHostKeys(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":                   "user@" + host + ":" + t.TempDir(),
+		"port":                     port,
+		"password":                 "secret",
+		"strict_host_key_checking": StrictHostKeyCheckingAcceptNew,
+	})
+
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Volume.Status["capacity_error"]; !ok {
+		t.Fatalf("Expected the unknown host key to fail the capacity query, got %v", res.Volume.Status)
+	}
+	knownHosts, err := ioutil.ReadFile(d.volumes["vol"].KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(knownHosts) != 0 {
+		t.Fatalf("Expected the status not to record the host key, got %q", knownHosts)
+	}
+}
+
+func TestHungCapacityQuery(t *testing.T) {
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", nil)
+	vol := d.volumes["vol"]
+
+	// A query that hangs, like a statfs of a mount whose server stopped responding
+	hung := &capacityQuery{started: time.Now().Add(-CapacityTimeout), done: make(chan struct{})}
+	d.capacityQueries[vol] = hung
+
+	start := time.Now()
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := res.Volume.Status["capacity_error"].(string); !strings.Contains(msg, "timed out") {
+		t.Fatalf("Expected the query to time out, got %v", res.Volume.Status)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the timed out query not to be waited for again, it took %s", elapsed)
+	}
+	if d.capacityQueries[vol] != hung {
+		t.Fatal("Expected no second query while the first is in flight")
+	}
+
+	// The query in flight is shared
+	hung.status = map[string]interface{}{"capacity_total_bytes": uint64(3)}
+	hung.started = time.Now()
+	close(hung.done)
+	if res, err = d.Get(&volume.GetRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["capacity_total_bytes"] != uint64(3) {
+		t.Fatalf("Expected the status of the query in flight, got %v", res.Volume.Status)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Accepted values of the on_remove option
+const (
+	// OnRemoveKeep leaves the remote data when the volume is removed
+	OnRemoveKeep = "keep"
+	// OnRemoveDelete recursively deletes the remote path
+	OnRemoveDelete = "delete"
+	// OnRemoveArchive renames the remote path to a timestamped path
+	OnRemoveArchive = "archive"
+)
+
+// ArchiveTimeFormat is the timestamp of archived remote paths
+const ArchiveTimeFormat = "20060102T150405Z"
+
+func validOnRemove(val string) bool {
+	return val == OnRemoveKeep || val == OnRemoveDelete || val == OnRemoveArchive
+}
+
+// onRemove returns what happens to the remote data when the volume is removed
+func (v *sshfsVolume) onRemove() string {
+	if v.OnRemove == "" {
+		return OnRemoveKeep
+	}
+	return v.OnRemove
+}
+
+// hasParentSegment returns whether the remote path has a '..' segment
+func hasParentSegment(remote string) bool {
+	for _, segment := range strings.Split(remote, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// withinPath returns whether the path is the directory or below it
+func withinPath(p string, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// checkRemovablePath refuses to delete or archive the filesystem root, top
+// level directories, the user's home directory and the directories above it,
+// and the other home directories next to it and their content
+func checkRemovablePath(root string, home string) error {
+	root = path.Clean(root)
+	home = path.Clean(home)
+	homes := path.Dir(home)
+	switch {
+	case root == "/" || path.Dir(root) == "/":
+		return fmt.Errorf("the remote path %s is a root or top level directory", root)
+	case withinPath(home, root):
+		return fmt.Errorf("the remote path %s is the home directory %s or above it", root, home)
+	case homes != "/" && withinPath(root, homes) && !withinPath(root, home):
+		return fmt.Errorf("the remote path %s is in %s, next to the home directory %s", root, homes, home)
+	}
+	return nil
+}
+
+// checkOverlappingVolumes refuses to delete or archive a remote path that
+// another volume on the same server uses, or that holds or is held by the
+// remote path of another volume. The relative paths of other users are
+// assumed to be in their home directory next to the user's.
+func (v *sshfsVolume) checkOverlappingVolumes(root string, home string, others []*sshfsVolume) error {
+	for _, other := range others {
+		if other.sshAddress() != v.sshAddress() {
+			continue
+		}
+		otherRoot := other.remotePath()
+		if !path.IsAbs(otherRoot) {
+			otherHome := home
+			if other.sshUser() != v.sshUser() {
+				otherHome = path.Join(path.Dir(home), other.sshUser())
+			}
+			otherRoot = path.Join(otherHome, otherRoot)
+		}
+		otherRoot = path.Clean(otherRoot)
+		if withinPath(root, otherRoot) || withinPath(otherRoot, root) {
+			return fmt.Errorf("the remote path %s overlaps the remote path %s of volume %s", root, otherRoot, other.Name)
+		}
+	}
+	return nil
+}
+
+// archivePath returns the path that the remote path is archived at
+func archivePath(root string, now time.Time) string {
+	return strings.TrimSuffix(root, "/") + ".removed-" + now.UTC().Format(ArchiveTimeFormat)
+}
+
+// cleanupRemote deletes or archives the volume's remote path as set by its
+// on_remove option, unless one of the other volumes uses the remote path.
+// The connection is dropped at the deadline, which leaves a deletion partial.
+func (v *sshfsVolume) cleanupRemote(deadline time.Time, others []*sshfsVolume) error {
+	action := v.onRemove()
+	if action == OnRemoveKeep {
+		return nil
+	}
+
+	sshClient, err := v.dialSSHBefore(deadline)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return fmt.Errorf("failed to start the sftp session (%s)", err)
+	}
+	defer sftpClient.Close()
+
+	home, err := sftpClient.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to resolve the remote home directory (%s)", err)
+	}
+	root := v.remotePath()
+	if hasParentSegment(root) {
+		return fmt.Errorf("refusing to %s, the remote path %s has a '..' segment", action, root)
+	}
+	if !path.IsAbs(root) {
+		root = path.Join(home, root)
+	}
+	if err := checkRemovablePath(root, home); err != nil {
+		return fmt.Errorf("refusing to %s, %s", action, err)
+	}
+	if err := v.checkOverlappingVolumes(root, home, others); err != nil {
+		return fmt.Errorf("refusing to %s, %s", action, err)
+	}
+	if _, err := sftpClient.Lstat(root); err != nil {
+		if os.IsNotExist(err) {
+			log.Infof("The remote path %s of volume %s no longer exists", root, v.Name)
+			return nil
+		}
+		return err
+	}
+
+	switch action {
+	case OnRemoveDelete:
+		if err := removeRemoteTree(sftpClient, root); err != nil {
+			return fmt.Errorf("failed to delete the remote path %s (%s)", root, err)
+		}
+		log.Infof("Deleted the remote path %s of volume %s", root, v.Name)
+	case OnRemoveArchive:
+		archive := archivePath(root, time.Now())
+		if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+			err = sftpClient.PosixRename(root, archive)
+		} else {
+			err = sftpClient.Rename(root, archive)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to archive the remote path %s to %s (%s)", root, archive, err)
+		}
+		log.Infof("Archived the remote path %s of volume %s to %s", root, v.Name, archive)
+	}
+	return nil
+}
+
+// removeRemoteTree deletes the remote path and its content.
+// Symlinks are removed rather than followed.
+func removeRemoteTree(client *sftp.Client, root string) error {
+	fi, err := client.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		entries, err := client.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeRemoteTree(client, path.Join(root, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return client.RemoveDirectory(root)
+	}
+	return client.Remove(root)
+}
+
+// cleanupRemote applies the volume's on_remove option before it is removed.
+// It takes at most the volume's mount timeout, since it holds up the removal.
+// A failure is logged rather than returned, such that the volume can
+// always be removed. The caller must hold vol.lock.
+func (d *sshfsDriver) cleanupRemote(logger *log.Entry, vol *sshfsVolume) {
+	d.mutex.RLock()
+	shredded := vol.keyShredded()
+	d.mutex.RUnlock()
+	key := ""
+	if shredded {
+		var err error
+		if key, err = d.provisionKey(vol); err != nil {
+			logger.Errorf("Failed to %s the remote data of volume %s (%s)", vol.onRemove(), vol.Name, err)
+			return
+		}
+	}
+
+	remote, err := d.prepareMount(vol)
+	if err != nil {
+		logger.Errorf("Failed to %s the remote data of volume %s (%s)", vol.onRemove(), vol.Name, err)
+		return
+	}
+	if key != "" {
+		remote.identityKey = key
+		remote.IdentityKeyFile = ""
+	}
+
+	d.mutex.RLock()
+	others := make([]*sshfsVolume, 0, len(d.volumes))
+	for name, other := range d.volumes {
+		if name != vol.Name {
+			others = append(others, d.snapshot(other))
+		}
+	}
+	d.mutex.RUnlock()
+
+	deadline := time.Now().Add(remote.mountTimeout(d.mountTimeout))
+	if err := remote.cleanupRemote(deadline, others); err != nil {
+		logger.Errorf("Failed to %s the remote data of volume %s (%s)", remote.onRemove(), vol.Name, err)
+		return
+	}
+	logger.WithField("on_remove", remote.onRemove()).Info("Cleaned up the remote data")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/pkg/sftp"
+)
+
+func TestCheckRemovablePath(t *testing.T) {
+	for _, root := range []string{
+		"/", "/data", "/data/", "/home", "/home/user", "/home/user/",
+		"/home/other", "/home/other/project", "/home/user2/project",
+	} {
+		if err := checkRemovablePath(root, "/home/user"); err == nil {
+			t.Errorf("Expected %s to be refused", root)
+		}
+	}
+	for _, root := range []string{"/srv/users", "/srv/users/alice", "/srv/users/bob/project"} {
+		if err := checkRemovablePath(root, "/srv/users/alice"); err == nil {
+			t.Errorf("Expected %s to be refused for the home directory /srv/users/alice", root)
+		}
+	}
+	for _, root := range []string{"/data/project", "/home/user/project", "/home/user/project/results"} {
+		if err := checkRemovablePath(root, "/home/user"); err != nil {
+			t.Errorf("Expected %s to be removable, got %s", root, err)
+		}
+	}
+	// The home directory of root is a top level directory
+	if err := checkRemovablePath("/data/project", "/root"); err != nil {
+		t.Errorf("Expected /data/project to be removable for root, got %s", err)
+	}
+
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	if archive := archivePath("/data/project/", now); archive != "/data/project.removed-20261018T123000Z" {
+		t.Fatalf("Unexpected archive path %s", archive)
+	}
+}
+
+func TestCheckOverlappingVolumes(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", SSHCmd: "user@host:/data/project"}
+	for _, sshcmd := range []string{
+		"user@host:/data/project",
+		"other@host:/data/project/results",
+		"user@host:/data",
+	} {
+		other := &sshfsVolume{Name: "other", SSHCmd: sshcmd}
+		if err := vol.checkOverlappingVolumes("/data/project", "/home/user", []*sshfsVolume{other}); err == nil {
+			t.Errorf("Expected the remote path of %s to overlap", sshcmd)
+		}
+	}
+	for _, sshcmd := range []string{
+		"user@host:/data/project2",
+		"user@otherhost:/data/project",
+		"user@host:/data/other",
+	} {
+		other := &sshfsVolume{Name: "other", SSHCmd: sshcmd}
+		if err := vol.checkOverlappingVolumes("/data/project", "/home/user", []*sshfsVolume{other}); err != nil {
+			t.Errorf("Expected the remote path of %s not to overlap, got %s", sshcmd, err)
+		}
+	}
+
+	// Relative paths are in the home directory of their user
+	vol = &sshfsVolume{Name: "vol", SSHCmd: "user@host:project"}
+	same := &sshfsVolume{Name: "same", SSHCmd: "user@host:project/results"}
+	if err := vol.checkOverlappingVolumes("/home/user/project", "/home/user", []*sshfsVolume{same}); err == nil {
+		t.Error("Expected the relative remote paths of the same user to overlap")
+	}
+	other := &sshfsVolume{Name: "other", SSHCmd: "other@host:project"}
+	if err := vol.checkOverlappingVolumes("/home/user/project", "/home/user", []*sshfsVolume{other}); err != nil {
+		t.Errorf("Expected the relative remote path of another user not to overlap, got %s", err)
+	}
+}
+
+func TestOnRemoveOption(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"sshcmd": "user@host:/data/project", "on_remove": "shred"},
+		{"sshcmd": "user@host:/data", "on_remove": OnRemoveDelete},
+		{"sshcmd": "user@host:", "on_remove": OnRemoveArchive},
+		{"sshcmd": "user@host:/", "on_remove": OnRemoveDelete},
+		{"sshcmd": "user@host:/data/project/../..", "on_remove": OnRemoveDelete},
+		{"sshcmd": "user@host:project/../../other", "on_remove": OnRemoveArchive},
+	} {
+		options["password"] = "pw"
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		if err := vol.setupOptions(options); err == nil {
+			t.Errorf("Expected the options %v to be rejected", redactOptions(options))
+		}
+	}
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	if err := vol.setupOptions(map[string]string{"sshcmd": "user@host:project", "password": "pw", "on_remove": OnRemoveDelete}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createRemoteTestVolume creates a volume whose remote path is
+// a directory with content, served by a test ssh server
+func createRemoteTestVolume(t *testing.T, d *sshfsDriver, address string, onRemove string) string {
+	host, port, _ := net.SplitHostPort(address)
+	remote := filepath.Join(t.TempDir(), "data", "project")
+	if err := os.MkdirAll(filepath.Join(remote, "results"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "results", "output"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks are removed without deleting their target
+	if err := os.Symlink(t.TempDir(), filepath.Join(remote, "link")); err != nil {
+		t.Fatal(err)
+	}
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":    "user@" + host + ":" + remote,
+		"port":      port,
+		"password":  "secret",
+		"on_remove": onRemove,
+	})
+	return remote
+}
+
+func TestRemoveDeletesRemotePath(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	remote := createRemoteTestVolume(t, d, address, OnRemoveDelete)
+	target, err := os.Readlink(filepath.Join(remote, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(remote); !os.IsNotExist(err) {
+		t.Fatal("Expected the remote path to be deleted")
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Fatal("Expected the target of the symlink to be kept")
+	}
+}
+
+func TestRemoveArchivesRemotePath(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	remote := createRemoteTestVolume(t, d, address, OnRemoveArchive)
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(remote); !os.IsNotExist(err) {
+		t.Fatal("Expected the remote path to be moved")
+	}
+	archives, err := filepath.Glob(remote + ".removed-*")
+	if err != nil || len(archives) != 1 {
+		t.Fatalf("Expected one archive of the remote path, got %v", archives)
+	}
+	if _, err := os.Stat(filepath.Join(archives[0], "results", "output")); err != nil {
+		t.Fatal("Expected the archive to hold the remote data")
+	}
+}
+
+func TestRemoveWithFailedCleanup(t *testing.T) {
+	address := testSSHServer(t, "secret", sftp.ReadOnly())
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	remote := createRemoteTestVolume(t, d, address, OnRemoveDelete)
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.volumes["vol"]; ok {
+		t.Fatal("Expected the volume to be removed although its remote data couldn't be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(remote, "results", "output")); err != nil {
+		t.Fatal("Expected the remote data to be kept")
+	}
+}
+
+func TestRemoveWithStalledServer(t *testing.T) {
+	// The server accepts the connection but never answers the sftp session
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	address := testSSHServer(t, "secret", func(*sftp.Server) error {
+		<-stalled
+		return nil
+	})
+	host, port, _ := net.SplitHostPort(address)
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":        "user@" + host + ":/data/project",
+		"port":          port,
+		"password":      "secret",
+		"on_remove":     OnRemoveDelete,
+		"mount_timeout": "300ms",
+	})
+
+	start := time.Now()
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the cleanup to end at the volume's mount timeout, it took %s", elapsed)
+	}
+}
+
+func TestRemoveKeepsOverlappingRemotePath(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	remote := createRemoteTestVolume(t, d, address, OnRemoveDelete)
+	createTestVolume(t, d, "results", map[string]string{
+		"sshcmd":   "other@" + host + ":" + filepath.Join(remote, "results"),
+		"port":     port,
+		"password": "secret",
+	})
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "results", "output")); err != nil {
+		t.Fatal("Expected the remote path to be kept while another volume uses it")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SecretsDir is where the plugin's secrets mount holds credential files
+	SecretsDir = "/mnt/secrets"
+	// SSHKeyDir is where the plugin's sshkey mount holds ssh keys
+	SSHKeyDir = "/root/.ssh"
+)
+
+// credentialDirs are the directories that credential files may be read from
+var credentialDirs = []string{SecretsDir, SSHKeyDir}
+
+// resolveCredentialFile returns the path of a password_file or id_rsa_file
+// option. Relative paths are resolved against the SecretsDir, and the file
+// must be inside one of the credentialDirs after following symlinks.
+func resolveCredentialFile(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("the credential file path can't be empty")
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(SecretsDir, path)
+	}
+	path = filepath.Clean(path)
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("the credential file %s is not accessible (%s)", name, err)
+	}
+
+	for _, dir := range credentialDirs {
+		if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolvedDir
+		}
+		if strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("the credential file %s must be inside one of %s", name, strings.Join(credentialDirs, ", "))
+}
+
+// readCredentialFile reads the credential file at path, which is validated
+// again since the file or a symlink to it may have changed since creation
+func readCredentialFile(path string) (string, error) {
+	resolved, err := resolveCredentialFile(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the credential file %s (%s)", path, err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("the credential file %s is empty", path)
+	}
+	return string(data), nil
+}
+
+// loadCredentials returns the password and private key content that the
+// volume authenticates with. Credentials referenced by file are read on every
+// call such that a rotated file takes effect on the next mount.
+func (v *sshfsVolume) loadCredentials() (password string, key string, err error) {
+	password = v.Password
+	if v.PasswordFile != "" {
+		if password, err = readCredentialFile(v.PasswordFile); err != nil {
+			return "", "", err
+		}
+		password = strings.TrimRight(password, "\r\n")
+	}
+
+	key = v.identityKey
+	if v.IdentityKeyFile != "" {
+		if key, err = readCredentialFile(v.IdentityKeyFile); err != nil {
+			return "", "", err
+		}
+		if !strings.HasSuffix(key, "\n") {
+			key += "\n"
+		}
+	}
+
+	// ssh can't prompt for the passphrase, so the key is decrypted
+	// and passed on like a key of the ssh_key option
+	if v.keyPassphrase != "" {
+		if key == "" && v.IdentityFile != "" {
+			data, err := ioutil.ReadFile(v.IdentityFile)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to read the identity_file %s (%s)", v.IdentityFile, err)
+			}
+			key = string(data)
+		}
+		if key, err = decryptKey(key, v.keyPassphrase); err != nil {
+			return "", "", err
+		}
+	}
+	return password, key, nil
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,61 +31,255 @@ type sshfsVolume struct {
 	CreatedAt string
 	// Number of containers that are using the volume
 	RefCount int
+	// Mount request IDs of the containers that are using the volume,
+	// mapped to the time at which each of them mounted it
+	MountIDs map[string]string
+	// Either the exec or native backend
+	Backend string `json:",omitempty"`
+	// How long mounting may take, overrides the plugin's MOUNT_TIMEOUT
+	MountTimeout string `json:",omitempty"`
+	// Whether the volume shares the ssh connection to its server
+	// with other volumes, overrides the plugin's MULTIPLEX
+	Multiplex string `json:",omitempty"`
+	// Connection profile that the volume's options are merged with,
+	// and the volume's own options, without inline secrets
+	Profile        string            `json:",omitempty"`
+	ProfileOptions map[string]string `json:",omitempty"`
 	// sshfs options
 	Options []string
 	SSHCmd  string
+	// Create the remote path if it doesn't exist when mounting,
+	// with the given octal mode and group
+	CreateRemotePath bool   `json:",omitempty"`
+	RemoteMode       string `json:",omitempty"`
+	RemoteGroup      string `json:",omitempty"`
+	// What happens to the remote path when the volume is removed,
+	// either keep, delete or archive
+	OnRemove string `json:",omitempty"`
+	// Free space that the remote filesystem must have for the volume to
+	// be mounted, either a size such as 10G or a percentage such as 5%
+	MinFree string `json:",omitempty"`
 	// File that contains the private key
 	IdentityFile string
 	// Should the private key be ephemeral
 	// Shall it be removed after the first mount
 	Ephemeral bool
-	// Password used to authenticate
-	Password string
+	// When the ephemeral key was removed
+	KeyShreddedAt string `json:",omitempty"`
+	// Password used to authenticate, only kept in memory.
+	// It is only read from state files that predate sealed secrets.
+	Password string `json:",omitempty"`
+	// Password, private key and its passphrase sealed by the driver's secret store
+	SealedPassword      string `json:",omitempty"`
+	SealedIdentityKey   string `json:",omitempty"`
+	SealedKeyPassphrase string `json:",omitempty"`
+	// Credential files that are read on every mount
+	PasswordFile    string `json:",omitempty"`
+	IdentityKeyFile string `json:",omitempty"`
+	// Content of the private key passed with ssh_key or id_rsa, only kept in memory.
+	// It is written to the IdentityFile for the duration of a mount.
+	identityKey string
+	// Which of ssh_key or id_rsa passed the private key
+	KeyOption string `json:",omitempty"`
+	// Passphrase of the private key, only kept in memory
+	keyPassphrase string
+	// Type and SHA256 fingerprint of the private key, if it was available at creation
+	KeyType        string `json:",omitempty"`
+	KeyFingerprint string `json:",omitempty"`
+	// Serializes the mounts, unmounts and removal of the volume
+	lock *sync.Mutex
 	// Port on which the volume will try to connect with SSH
 	Port string
+	// File that contains the known host keys of the server
+	KnownHostsFile string
+	// SHA256 fingerprint that the server's host key must match
+	HostKeyFingerprint string
+	// How ssh verifies the server's host key, either yes, accept-new or no
+	StrictHostKeyChecking string
+	// Jump host through which the server is reached, with its own
+	// credentials and known_hosts file
+	JumpHost           string `json:",omitempty"`
+	JumpPort           string `json:",omitempty"`
+	JumpUser           string `json:",omitempty"`
+	JumpIdentityFile   string `json:",omitempty"`
+	JumpKnownHostsFile string `json:",omitempty"`
+	SealedJumpPassword string `json:",omitempty"`
+	// Password of the jump host, only kept in memory
+	jumpPassword string
+	// When the current sshfs connection was established
+	ConnectedAt string
+	// Number of times the connection has been reestablished
+	ReconnectCount int
+	// The last connection error and when it occurred
+	LastError   string
+	LastErrorAt string
+	// Capacity of the remote filesystem while the volume is unmounted,
+	// only kept in memory
+	capacity *cachedCapacity
+	// When the mount in progress must be done by, only set on
+	// the copy of the volume that is passed to the mounter
+	mountDeadline time.Time
 }
 
 type sshfsDriver struct {
-	mutex      *sync.Mutex
-	volumes    map[string]*sshfsVolume
-	volumePath string
-	statePath  string
+	// Guards the volume and supervisor maps and the fields of the volumes.
+	// It is never held while mounting or unmounting.
+	mutex *sync.RWMutex
+	// Executable that provisions new keys for ephemeral volumes
+	keyHook string
+	// The mount timeout of volumes that don't set their own
+	mountTimeout time.Duration
+	// The boot of the host that the driver runs in
+	bootID string
+	// How often mounted volumes are checked, and the delays between failed reconnects
+	healthCheckInterval time.Duration
+	reconnectMinBackoff time.Duration
+	reconnectMaxBackoff time.Duration
+	// The volumes that are locked until reconcile has checked their mounts
+	unreconciled []*sshfsVolume
+	// Orders the writes of the state file
+	stateMutex  *sync.Mutex
+	volumes     map[string]*sshfsVolume
+	supervisors map[string]*volumeSupervisor
+	// The names of the volumes that are being created
+	creating map[string]bool
+	// The capacity queries in flight, at most one per volume
+	capacityQueries map[*sshfsVolume]*capacityQuery
+	mounter         Mounter
+	policy          *optionPolicy
+	volumePath      string
+	statePath       string
+	profilesPath    string
+	secrets         secretStore
 }
 
 func (v *sshfsVolume) setupOptions(options map[string]string) error {
+	var keyOptions []string
+	remotePath := ""
 	for key, val := range options {
 		switch key {
 		case "sshcmd":
 			v.SSHCmd = val
+		case "remote_path":
+			remotePath = val
 		case "password":
 			v.Password = val
 		case "port":
 			v.Port = val
+		case "password_file":
+			path, err := resolveCredentialFile(val)
+			if err != nil {
+				return err
+			}
+			v.PasswordFile = path
 		case "identity_file":
 			v.IdentityFile = val
-		case "id_rsa":
+			keyOptions = append(keyOptions, key)
+		case "id_rsa_file":
+			path, err := resolveCredentialFile(val)
+			if err != nil {
+				return err
+			}
+			// The key is copied to the v.MountPoint + "_id_rsa" file
+			// when mounting, since ssh refuses keys that others can read
+			v.IdentityFile = v.keyFile()
+			v.IdentityKeyFile = path
+			keyOptions = append(keyOptions, key)
+		case "ssh_key", "id_rsa":
+			keyOptions = append(keyOptions, key)
 			if val != "" {
-				// Private keys should end in '\n' such
-				// that the created v.MountPoint + "_id_rsa"
-				// file is a valid IdentityFile.
-				lastChar := string(val[len(val)-1])
-				if lastChar != "\n" {
-					val += "\n"
+				decoded, err := decodeKey(val)
+				if err != nil {
+					return fmt.Errorf("invalid '%s' option, %s", key, err)
 				}
 
-				// Copy the value of the id_rsa argument
-				// and save as a prefix to the v.MountPoint
-				v.IdentityFile = v.MountPoint + "_id_rsa"
-				if err := v.saveKey(val); err != nil {
-					return err
-				}
+				// Keep the value of the key in memory,
+				// it is saved as a prefix to the v.MountPoint when mounting
+				v.IdentityFile = v.keyFile()
+				v.identityKey = decoded
+				v.KeyOption = key
+			}
+		case "key_passphrase":
+			v.keyPassphrase = val
+		case "jump_host":
+			v.JumpHost = val
+		case "jump_port":
+			v.JumpPort = val
+		case "jump_user":
+			v.JumpUser = val
+		case "jump_identity":
+			v.JumpIdentityFile = val
+		case "jump_password":
+			v.jumpPassword = val
+		case "jump_known_hosts":
+			v.JumpKnownHostsFile = v.MountPoint + "_jump_known_hosts"
+			if err := saveKnownHostsFile(v.JumpKnownHostsFile, val); err != nil {
+				return err
+			}
+		case "known_hosts":
+			v.KnownHostsFile = v.MountPoint + "_known_hosts"
+			if err := v.saveKnownHosts(val); err != nil {
+				return err
+			}
+		case "host_key_fingerprint":
+			fingerprint, err := normalizeFingerprint(val)
+			if err != nil {
+				return err
+			}
+			v.HostKeyFingerprint = fingerprint
+		case "strict_host_key_checking":
+			if !validStrictHostKeyChecking(val) {
+				return fmt.Errorf("'strict_host_key_checking' must be one of yes, accept-new or no, not '%s'", val)
+			}
+			v.StrictHostKeyChecking = val
+		case "backend":
+			if !validBackend(val) {
+				return fmt.Errorf("'backend' must be either %s or %s, not '%s'", BackendExec, BackendNative, val)
 			}
+			v.Backend = val
+		case "mount_timeout":
+			if _, err := parseMountTimeout(val); err != nil {
+				return err
+			}
+			v.MountTimeout = val
+		case "multiplex":
+			multiplex, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("'multiplex' must be true or false, not '%s'", val)
+			}
+			v.Multiplex = strconv.FormatBool(multiplex)
 		case "ephemeral":
 			parsedBool, err := strconv.ParseBool(val)
 			if err != nil {
 				return err
 			}
 			v.Ephemeral = parsedBool
+		case "create_remote_path":
+			parsedBool, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("'create_remote_path' must be true or false, not '%s'", val)
+			}
+			v.CreateRemotePath = parsedBool
+		case "remote_mode":
+			if _, err := parseRemoteMode(val); err != nil {
+				return err
+			}
+			v.RemoteMode = val
+		case "on_remove":
+			if !validOnRemove(val) {
+				return fmt.Errorf("'on_remove' must be one of keep, delete or archive, not '%s'", val)
+			}
+			v.OnRemove = val
+		case "min_free":
+			if _, _, err := parseMinFree(val); err != nil {
+				return err
+			}
+			v.MinFree = val
+		case "remote_group":
+			if !validRemoteGroup(val) {
+				return fmt.Errorf("'remote_group' must be a group name or gid, not '%s'", val)
+			}
+			v.RemoteGroup = val
 		default:
 			if val != "" {
 				v.Options = append(v.Options, key+"="+val)
@@ -96,40 +289,262 @@ func (v *sshfsVolume) setupOptions(options map[string]string) error {
 		}
 	}
 
-	if v.SSHCmd == "" {
-		return fmt.Errorf("'sshcmd' option required")
+	target, err := parseSSHCmd(v.SSHCmd)
+	if err != nil {
+		return err
+	}
+	if remotePath != "" {
+		// Parse again such that the path is validated like the sshcmd's
+		target.Path = remotePath
+		if target, err = parseSSHCmd(target.String()); err != nil {
+			return err
+		}
+	}
+	if v.Port != "" {
+		if err := validatePort(v.Port); err != nil {
+			return err
+		}
+	}
+	if target.Port != "" {
+		if v.Port != "" && v.Port != target.Port {
+			return fmt.Errorf("the 'port' option %s conflicts with the port %s of 'sshcmd'", v.Port, target.Port)
+		}
+		v.Port = target.Port
+	}
+	// Normalize the sshcmd to the form that sshfs accepts
+	v.SSHCmd = target.String()
+
+	if v.Backend == BackendNative {
+		for _, option := range v.Options {
+			if !nativeOptions[option] {
+				return fmt.Errorf("the sshfs option '%s' is not supported by the native backend", option)
+			}
+		}
+	}
+
+	if v.Password != "" && v.PasswordFile != "" {
+		return fmt.Errorf("'password' and 'password_file' options are mutually exclusive")
+	}
+
+	if len(keyOptions) > 1 {
+		sort.Strings(keyOptions)
+		return fmt.Errorf("'%s' options are mutually exclusive", strings.Join(keyOptions, "', '"))
 	}
 
-	if v.Password == "" && v.IdentityFile == "" {
-		return fmt.Errorf("either 'password', 'identity_file', or 'id_rsa' option must be set")
+	hasPassword := v.Password != "" || v.PasswordFile != ""
+	if !hasPassword && v.IdentityFile == "" {
+		return fmt.Errorf("either 'password', 'password_file', 'identity_file', 'ssh_key', 'id_rsa', or 'id_rsa_file' option must be set")
 	}
 
-	if v.Password != "" && v.IdentityFile != "" {
-		return fmt.Errorf("'password' and 'identity_file'/'id_rsa' options are mutually exclusive")
+	if hasPassword && v.IdentityFile != "" {
+		return fmt.Errorf("'password'/'password_file' and 'identity_file'/'ssh_key'/'id_rsa'/'id_rsa_file' options are mutually exclusive")
+	}
+
+	if v.keyPassphrase != "" && v.IdentityFile == "" {
+		return fmt.Errorf("'key_passphrase' requires a key from 'identity_file', 'ssh_key', 'id_rsa' or 'id_rsa_file'")
+	}
+
+	// Bad keys fail when the volume is created rather than when it is mounted
+	if err := v.validateKey(); err != nil {
+		return err
+	}
+
+	if (v.RemoteMode != "" || v.RemoteGroup != "") && !v.CreateRemotePath {
+		return fmt.Errorf("'remote_mode' and 'remote_group' require 'create_remote_path=true'")
+	}
+
+	if v.onRemove() != OnRemoveKeep {
+		if root := path.Clean("/" + v.remotePath()); root == "/" || (path.IsAbs(v.remotePath()) && path.Dir(root) == "/") {
+			return fmt.Errorf("'on_remove=%s' requires a remote path below a top level directory or the home directory", v.OnRemove)
+		}
+		if hasParentSegment(v.remotePath()) {
+			return fmt.Errorf("'on_remove=%s' requires a remote path without '..' segments", v.OnRemove)
+		}
+	}
+
+	// Only the keys that the plugin holds are shredded, never key files on the host
+	if v.Ephemeral && (v.IdentityFile != v.keyFile() || v.IdentityKeyFile != "") {
+		return fmt.Errorf("'ephemeral' requires a key from 'ssh_key' or 'id_rsa', key files of 'identity_file' and 'id_rsa_file' are not shredded")
+	}
+
+	if v.StrictHostKeyChecking == "" {
+		if v.HostKeyFingerprint != "" || v.KnownHostsFile != "" || v.JumpKnownHostsFile != "" {
+			v.StrictHostKeyChecking = StrictHostKeyCheckingYes
+		} else {
+			v.StrictHostKeyChecking = StrictHostKeyCheckingNo
+		}
+	}
+
+	if v.HostKeyFingerprint != "" && v.StrictHostKeyChecking != StrictHostKeyCheckingYes {
+		return fmt.Errorf("'host_key_fingerprint' requires 'strict_host_key_checking=yes'")
+	}
+
+	if err := v.setupJump(); err != nil {
+		return err
+	}
+
+	// Host keys that are accepted or pinned are kept in a file of
+	// the volume instead of the shared /root/.ssh/known_hosts
+	if v.StrictHostKeyChecking != StrictHostKeyCheckingNo && v.KnownHostsFile == "" {
+		v.KnownHostsFile = v.MountPoint + "_known_hosts"
+		if err := v.createKnownHosts(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// addMount registers the mount request id as a user of the volume.
+// It returns false if the id was already registered.
+func (v *sshfsVolume) addMount(id string) bool {
+	if v.MountIDs == nil {
+		v.MountIDs = make(map[string]string)
+	}
+	if _, ok := v.MountIDs[id]; ok {
+		return false
+	}
+	v.MountIDs[id] = time.Now().Format(time.RFC3339Nano)
+	v.RefCount = len(v.MountIDs)
+	return true
+}
+
+// removeMount unregisters the mount request id as a user of the volume.
+// It returns false if the id was not registered.
+func (v *sshfsVolume) removeMount(id string) bool {
+	if _, ok := v.MountIDs[id]; !ok {
+		return false
+	}
+	delete(v.MountIDs, id)
+	v.RefCount = len(v.MountIDs)
+	return true
+}
+
+// mountIDs returns the sorted mount request ids that are using the volume
+func (v *sshfsVolume) mountIDs() []string {
+	ids := make([]string, 0, len(v.MountIDs))
+	for id := range v.MountIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// authMethod describes how the volume authenticates, without revealing the secret.
+// It is the option that provided the credential, and notes if the key has a passphrase.
+func (v *sshfsVolume) authMethod() string {
+	method := "none"
+	switch {
+	case v.Password != "" || v.SealedPassword != "":
+		return "password"
+	case v.PasswordFile != "":
+		return "password_file"
+	case v.IdentityKeyFile != "":
+		method = "id_rsa_file"
+	case v.IdentityFile != "" && v.IdentityFile == v.keyFile():
+		// Volumes from before the option was recorded passed the key with id_rsa
+		method = "id_rsa"
+		if v.KeyOption != "" {
+			method = v.KeyOption
+		}
+	case v.IdentityFile != "":
+		method = "identity_file"
+	default:
+		return method
+	}
+	if v.keyPassphrase != "" || v.SealedKeyPassphrase != "" {
+		method += " with passphrase"
+	}
+	return method
+}
+
+// toVolume returns the Docker representation of the volume including
+// its status, which is shown by `docker volume inspect`.
+// Secrets such as the password are never included.
+func (v *sshfsVolume) toVolume() *volume.Volume {
+	state := "unmounted"
+	if v.ConnectedAt != "" {
+		state = "mounted"
+	}
+
+	return &volume.Volume{
+		Name:       v.Name,
+		Mountpoint: v.MountPoint,
+		CreatedAt:  v.CreatedAt,
+		Status: map[string]interface{}{
+			"sshcmd":             v.SSHCmd,
+			"create_remote_path": v.CreateRemotePath,
+			"on_remove":          v.onRemove(),
+			"min_free":           v.MinFree,
+			"backend":            v.backend(),
+			"profile":            v.Profile,
+			"port":               v.Port,
+			"auth_method":        v.authMethod(),
+			"key_type":           v.KeyType,
+			"key_fingerprint":    v.KeyFingerprint,
+			"ephemeral":          v.Ephemeral,
+			"key_shredded_at":    v.KeyShreddedAt,
+			"host_key_check":     v.StrictHostKeyChecking,
+			"host_key_pin":       v.HostKeyFingerprint,
+			"jump_host":          v.jumpStatus(),
+			"options":            v.Options,
+			"state":              state,
+			"ref_count":          v.RefCount,
+			"mount_ids":          v.mountIDs(),
+			"connected_since":    v.ConnectedAt,
+			"reconnects":         v.ReconnectCount,
+			"last_error":         v.LastError,
+			"last_error_at":      v.LastErrorAt,
+		},
+	}
+}
+
+// backend returns the backend that mounts the volume
+func (v *sshfsVolume) backend() string {
+	if v.Backend == "" {
+		return BackendExec
+	}
+	return v.Backend
+}
+
+// keyFile returns the path at which a private key passed with id_rsa is saved
+func (v *sshfsVolume) keyFile() string {
+	return v.MountPoint + "_id_rsa"
+}
+
 func (v *sshfsVolume) saveKey(key string) error {
 	if key == "" {
 		return fmt.Errorf("can't save an empty key")
 	}
 
-	f, err := os.Create(v.IdentityFile)
+	f, err := os.OpenFile(v.keyFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, VolumeFileMode)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to create the identity_file file at %s (%s)", v.IdentityFile, err)
+		msg := fmt.Sprintf("Failed to create the identity_file file at %s (%s)", v.keyFile(), err)
 		log.Error(msg)
 		return fmt.Errorf(msg)
 	}
-	f.WriteString(key)
-	f.Chmod(VolumeFileMode)
-	f.Close()
+	defer f.Close()
+	if _, err := f.WriteString(key); err != nil {
+		return err
+	}
+	return f.Chmod(VolumeFileMode)
+}
 
-	return nil
+// driverConfig holds the operator's settings of the driver
+type driverConfig struct {
+	// Policy for the options that are passed through to sshfs
+	Policy *optionPolicy
+	// Executable that prints a new private key for an ephemeral volume
+	// whose key has been shredded, if any
+	KeyHook string
+	// The mount timeout of volumes that don't set their own,
+	// DefaultMountTimeout if unset
+	MountTimeout time.Duration
+	// File with the id of the host's boot, BootIDPath if unset
+	BootIDPath string
 }
 
-func newSshfsDriver(basePath string) (*sshfsDriver, error) {
+func newSshfsDriver(basePath string, secrets secretStore, mounter Mounter, config driverConfig) (*sshfsDriver, error) {
 	log.Infof("Creating a new driver instance %s", basePath)
 
 	volumePath := filepath.Join(basePath, "volumes")
@@ -142,177 +557,507 @@ func newSshfsDriver(basePath string) (*sshfsDriver, error) {
 	log.Infof("Initialized driver, volumes='%s' state='%s", volumePath, statePath)
 
 	driver := &sshfsDriver{
-		volumes:    make(map[string]*sshfsVolume),
-		volumePath: volumePath,
-		statePath:  statePath,
-		mutex:      &sync.Mutex{},
+		volumes:             make(map[string]*sshfsVolume),
+		supervisors:         make(map[string]*volumeSupervisor),
+		creating:            make(map[string]bool),
+		capacityQueries:     make(map[*sshfsVolume]*capacityQuery),
+		mounter:             mounter,
+		policy:              config.Policy,
+		keyHook:             config.KeyHook,
+		mountTimeout:        config.MountTimeout,
+		healthCheckInterval: HealthCheckInterval,
+		reconnectMinBackoff: ReconnectMinBackoff,
+		reconnectMaxBackoff: ReconnectMaxBackoff,
+		volumePath:          volumePath,
+		statePath:           statePath,
+		profilesPath:        filepath.Join(basePath, "state", "sshfs-profiles.json"),
+		secrets:             secrets,
+		mutex:               &sync.RWMutex{},
+		stateMutex:          &sync.Mutex{},
 	}
+	if driver.mountTimeout == 0 {
+		driver.mountTimeout = DefaultMountTimeout
+	}
+	bootIDPath := config.BootIDPath
+	if bootIDPath == "" {
+		bootIDPath = BootIDPath
+	}
+	driver.bootID = readBootID(bootIDPath)
 
-	data, err := ioutil.ReadFile(driver.statePath)
+	state, err := loadState(driver.statePath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Debugf("No state found at %s", driver.statePath)
-		} else {
+		return nil, err
+	}
+	driver.volumes = state.Volumes
+	// The mounts of the containers did not survive a reboot of the host
+	rebooted := state.BootID != "" && driver.bootID != "" && state.BootID != driver.bootID
+	if rebooted {
+		log.Infof("The host was rebooted since the state was saved, resetting the mounts of all volumes")
+	}
+
+	migrated := 0
+	var cleartextFiles []string
+	for _, vol := range driver.volumes {
+		cleartext, cleartextFile, err := driver.openVolume(vol)
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		if err := json.Unmarshal(data, &driver.volumes); err != nil {
+		if cleartext {
+			migrated++
+		}
+		if cleartextFile != "" {
+			cleartextFiles = append(cleartextFiles, cleartextFile)
+		}
+		vol.lock = &sync.Mutex{}
+		if vol.MountIDs == nil {
+			vol.MountIDs = make(map[string]string)
+		}
+		if rebooted {
+			vol.MountIDs = make(map[string]string)
+			vol.RefCount = 0
+			vol.ConnectedAt = ""
+		}
+		if vol.RefCount != len(vol.MountIDs) {
+			log.Warningf("Volume %s has a refcount of %d but %d known mount ids, using the mount ids",
+				vol.Name, vol.RefCount, len(vol.MountIDs))
+			vol.RefCount = len(vol.MountIDs)
+		}
+	}
+
+	if rebooted {
+		if err := driver.saveState(); err != nil {
 			return nil, err
 		}
 	}
+	if migrated > 0 {
+		log.Infof("Sealing the cleartext secrets of %d volumes", migrated)
+		// Saving twice replaces the backup of the cleartext state as well
+		for i := 0; i < 2; i++ {
+			if err := driver.saveState(); err != nil {
+				return nil, err
+			}
+		}
+		// The cleartext keys are only removed once they are sealed in the state
+		for _, path := range cleartextFiles {
+			if err := os.Remove(path); err != nil {
+				log.Errorf("Failed to remove the cleartext private key %s (%s)", path, err)
+			}
+		}
+	}
+
+	// Requests for the volumes wait until reconcile has checked their mounts
+	for _, vol := range driver.volumes {
+		vol.lock.Lock()
+		driver.unreconciled = append(driver.unreconciled, vol)
+	}
 	return driver, nil
 }
 
-func (d *sshfsDriver) saveState() {
-	data, err := json.Marshal(d.volumes)
+// reconcile compares the persisted volume state with the mounts that are
+// actually active, such as after a plugin restart or a host reboot.
+// Volumes that are in use but not mounted are remounted, or reset if that fails,
+// and volumes that are mounted without being in use are unmounted.
+// It runs once the driver serves requests, and each volume is unlocked
+// as soon as it is reconciled.
+func (d *sshfsDriver) reconcile(mountInfoPath string) error {
+	d.mutex.Lock()
+	volumes := d.unreconciled
+	d.unreconciled = nil
+	d.mutex.Unlock()
+
+	mounts, err := readMountInfo(mountInfoPath)
 	if err != nil {
-		log.Errorf("saveState failed %s", err)
-		return
+		for _, vol := range volumes {
+			vol.lock.Unlock()
+		}
+		return err
+	}
+
+	var consistent, remounted, reset, unmounted int
+	for _, vol := range volumes {
+		switch d.reconcileVolume(vol, mounts) {
+		case "consistent":
+			consistent++
+		case "remounted":
+			remounted++
+		case "reset":
+			reset++
+		case "unmounted":
+			unmounted++
+		}
+		vol.lock.Unlock()
+	}
+
+	log.Infof("Reconciled %d volumes: %d consistent, %d remounted, %d reset, %d unmounted",
+		len(volumes), consistent, remounted, reset, unmounted)
+	if remounted+reset+unmounted > 0 {
+		return d.saveState()
+	}
+	return nil
+}
+
+// reconcileVolume reconciles the volume with the active mounts and returns
+// what was done, if anything. The caller must hold vol.lock but not d.mutex.
+func (d *sshfsDriver) reconcileVolume(vol *sshfsVolume, mounts map[string]string) string {
+	d.mutex.RLock()
+	_, mounted := mounts[vol.MountPoint]
+	inUse := len(vol.MountIDs) > 0
+	d.mutex.RUnlock()
+
+	switch {
+	case mounted == inUse:
+		d.mutex.Lock()
+		if inUse {
+			d.startSupervisor(vol)
+		} else {
+			vol.ConnectedAt = ""
+		}
+		d.mutex.Unlock()
+		return "consistent"
+	case inUse:
+		log.Infof("Volume %s is used by %d containers but not mounted, remounting", vol.Name, len(vol.MountIDs))
+		if err := d.mountVolume(vol); err != nil {
+			log.Errorf("Failed to remount volume %s, resetting its mounts (%s)", vol.Name, err)
+			d.mutex.Lock()
+			vol.MountIDs = make(map[string]string)
+			vol.RefCount = 0
+			vol.ConnectedAt = ""
+			d.mutex.Unlock()
+			return "reset"
+		}
+		d.mutex.Lock()
+		d.startSupervisor(vol)
+		d.mutex.Unlock()
+		return "remounted"
+	default:
+		log.Infof("Volume %s is mounted but not used by any container, unmounting", vol.Name)
+		if err := d.unmountVolume(vol); err != nil {
+			log.Errorf("Failed to unmount unused volume %s (%s)", vol.Name, err)
+			return ""
+		}
+		return "unmounted"
+	}
+}
+
+// saveState writes the state of all volumes.
+// The caller must not hold d.mutex.
+func (d *sshfsDriver) saveState() error {
+	// The state is copied and written under the same lock
+	// such that an older copy never replaces a newer one
+	d.stateMutex.Lock()
+	defer d.stateMutex.Unlock()
+
+	d.mutex.RLock()
+	volumes := make(map[string]*sshfsVolume, len(d.volumes))
+	for name, vol := range d.volumes {
+		sealed, err := d.sealVolume(vol)
+		if err != nil {
+			d.mutex.RUnlock()
+			msg := fmt.Sprintf("Failed to seal the secrets of volume %s (%s)", name, err)
+			log.Error(msg)
+			return fmt.Errorf(msg)
+		}
+		volumes[name] = sealed
 	}
+	d.mutex.RUnlock()
 
-	if err := ioutil.WriteFile(d.statePath, data, VolumeFileMode); err != nil {
-		log.Errorf("Failed to write state %s to %s (%s)", data, d.statePath, err)
+	if err := writeState(d.statePath, volumes, d.bootID); err != nil {
+		msg := fmt.Sprintf("Failed to write state to %s (%s)", d.statePath, err)
+		log.Error(msg)
+		return fmt.Errorf(msg)
 	}
+	return nil
 }
 
 // Driver API
-func (d *sshfsDriver) Create(r *volume.CreateRequest) error {
-	log.Debugf("Create Request %s", r)
+func (d *sshfsDriver) Create(r *volume.CreateRequest) (err error) {
+	logger := requestLogger("create", r.Name)
+	logger.WithField("options", redactOptions(r.Options)).Debug("Create request")
+	defer logRequest(logger, time.Now(), &err)
+
+	if err := validateVolumeName(r.Name); err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	// The name is reserved, such that the files of an existing
+	// volume are never replaced by those of a new one
 	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	_, exists := d.volumes[r.Name]
+	if exists || d.creating[r.Name] {
+		d.mutex.Unlock()
+		msg := fmt.Sprintf("Failed to create volume %s because it already exists", r.Name)
+		logger.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	d.creating[r.Name] = true
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.creating, r.Name)
+		d.mutex.Unlock()
+	}()
 
 	vol, err := d.newVolume(r.Name)
 	if err != nil {
 		return err
 	}
 
-	if err := vol.setupOptions(r.Options); err != nil {
+	options := r.Options
+	if name, ok := r.Options["profile"]; ok {
+		if options, err = d.profileOptions(name, r.Options); err != nil {
+			logger.Error(err)
+			d.discardVolume(vol)
+			return err
+		}
+		delete(options, "profile")
+		vol.Profile = name
+		vol.ProfileOptions = profileOverrides(r.Options)
+	}
+
+	if err := vol.setupOptions(options); err != nil {
+		logger.Error(err)
+		d.discardVolume(vol)
+		return err
+	}
+	logger = volumeLogger(logger, vol)
+
+	if err := d.policy.validate(vol.Options); err != nil {
+		logger.Error(err)
+		d.discardVolume(vol)
 		return err
 	}
 
+	if err := d.checkSecretKey(vol); err != nil {
+		logger.Error(err)
+		d.discardVolume(vol)
+		return err
+	}
+
+	d.mutex.Lock()
 	d.volumes[r.Name] = vol
-	d.saveState()
+	d.mutex.Unlock()
+	if err := d.saveState(); err != nil {
+		d.mutex.Lock()
+		if d.volumes[r.Name] == vol {
+			delete(d.volumes, r.Name)
+		}
+		d.mutex.Unlock()
+		d.removeVolume(vol)
+		return err
+	}
 	return nil
 }
 
 func (d *sshfsDriver) List() (*volume.ListResponse, error) {
-	log.Debugf("List Request")
+	requestLogger("list", "").Debug("List request")
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 
 	var vols = []*volume.Volume{}
 	for _, vol := range d.volumes {
-		vols = append(vols,
-			&volume.Volume{Name: vol.Name, Mountpoint: vol.MountPoint})
+		vols = append(vols, d.describe(vol))
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
 func (d *sshfsDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
-	log.Debugf("Get Request %s", r)
-
+	logger := requestLogger("get", r.Name)
+	logger.Debug("Get request")
+	d.mutex.RLock()
 	vol, ok := d.volumes[r.Name]
 	if !ok {
+		d.mutex.RUnlock()
 		msg := fmt.Sprintf("Failed to get volume %s because it doesn't exists", r.Name)
-		log.Error(msg)
+		logger.Error(msg)
 		return &volume.GetResponse{}, fmt.Errorf(msg)
 	}
+	v := d.describe(vol)
+	d.mutex.RUnlock()
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: vol.Name, Mountpoint: vol.MountPoint}}, nil
+	// The capacity is queried without holding d.mutex or vol.lock, since it
+	// might have to connect to the server
+	for key, val := range d.capacityStatus(vol) {
+		v.Status[key] = val
+	}
+	return &volume.GetResponse{Volume: v}, nil
 }
 
-func (d *sshfsDriver) Remove(r *volume.RemoveRequest) error {
-	log.Debugf("Remove Request %s", r)
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *sshfsDriver) Remove(r *volume.RemoveRequest) (err error) {
+	logger := requestLogger("remove", r.Name)
+	logger.Debug("Remove request")
+	defer logRequest(logger, time.Now(), &err)
 
-	vol, ok := d.volumes[r.Name]
+	vol, ok := d.lockVolume(r.Name)
 	if !ok {
 		msg := fmt.Sprintf("Failed to remove volume %s because it doesn't exists", r.Name)
-		log.Error(msg)
+		logger.Error(msg)
 		return fmt.Errorf(msg)
 	}
+	defer vol.lock.Unlock()
+	logger = volumeLogger(logger, vol)
 
-	if vol.RefCount > 0 {
-		msg := fmt.Sprintf("Can't remove volume %s because it is mounted by %d containers", vol.Name, vol.RefCount)
-		log.Error(msg)
+	d.mutex.RLock()
+	refCount := vol.RefCount
+	d.mutex.RUnlock()
+	if refCount > 0 {
+		msg := fmt.Sprintf("Can't remove volume %s because it is mounted by %d containers", vol.Name, refCount)
+		logger.Error(msg)
 		return fmt.Errorf(msg)
 	}
 
+	if vol.onRemove() != OnRemoveKeep {
+		d.cleanupRemote(logger, vol)
+	}
+
 	if err := d.removeVolume(vol); err != nil {
 		return err
 	}
 
+	d.mutex.Lock()
 	delete(d.volumes, vol.Name)
-	d.saveState()
-	return nil
+	d.mutex.Unlock()
+	return d.saveState()
 }
 
 func (d *sshfsDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
-	log.Debugf("Path Request %s", r)
+	logger := requestLogger("path", r.Name)
+	logger.Debug("Path request")
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
 	vol, ok := d.volumes[r.Name]
 	if !ok {
 		msg := fmt.Sprintf("Failed to find path for volume %s because it doesn't exists", r.Name)
-		log.Error(msg)
+		logger.Error(msg)
 		return &volume.PathResponse{}, fmt.Errorf(msg)
 	}
 
 	return &volume.PathResponse{Mountpoint: vol.MountPoint}, nil
 }
 
-func (d *sshfsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
-	log.Debugf("Mount Request %s", r)
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *sshfsDriver) Mount(r *volume.MountRequest) (res *volume.MountResponse, err error) {
+	logger := requestLogger("mount", r.Name).WithField("mount_id", r.ID)
+	logger.Debug("Mount request")
+	defer logRequest(logger, time.Now(), &err)
 
-	vol, ok := d.volumes[r.Name]
+	vol, ok := d.lockVolume(r.Name)
 	if !ok {
 		msg := fmt.Sprintf("Failed to mount volume %s because it doesn't exists", r.Name)
-		log.Error(msg)
+		logger.Error(msg)
 		return &volume.MountResponse{}, fmt.Errorf(msg)
 	}
+	defer vol.lock.Unlock()
+	logger = volumeLogger(logger, vol)
+
+	d.mutex.RLock()
+	_, mounted := vol.MountIDs[r.ID]
+	first := len(vol.MountIDs) == 0
+	d.mutex.RUnlock()
+	if mounted {
+		logger.Debugf("Volume %s is already mounted for %s", vol.Name, r.ID)
+		return &volume.MountResponse{Mountpoint: vol.MountPoint}, nil
+	}
 
-	if vol.RefCount == 0 {
-		log.Debugf("First volume mount %s establish connection to %s", vol.Name, vol.SSHCmd)
+	if first {
+		logger.Debugf("First volume mount %s establish connection", vol.Name)
 		if err := d.mountVolume(vol); err != nil {
 			msg := fmt.Sprintf("Failed to mount %s, %s", vol.Name, err)
-			log.Error(msg)
+			logger.Error(msg)
+			d.mutex.Lock()
+			vol.LastError = err.Error()
+			vol.LastErrorAt = time.Now().Format(time.RFC3339Nano)
+			d.mutex.Unlock()
+			d.saveState()
 			return &volume.MountResponse{}, fmt.Errorf(msg)
 		}
 	}
-	vol.RefCount++
-	d.saveState()
+	d.mutex.Lock()
+	if first {
+		d.startSupervisor(vol)
+	}
+	vol.addMount(r.ID)
+	d.mutex.Unlock()
+	if err := d.saveState(); err != nil {
+		// Docker considers the mount failed, so don't keep it
+		d.mutex.Lock()
+		vol.removeMount(r.ID)
+		unused := len(vol.MountIDs) == 0
+		if unused {
+			d.stopSupervisor(vol)
+		}
+		d.mutex.Unlock()
+		if unused {
+			if uerr := d.unmountVolume(vol); uerr != nil {
+				logger.Errorf("Failed to unmount %s after the state couldn't be saved (%s)", vol.Name, uerr)
+			}
+		}
+		return &volume.MountResponse{}, err
+	}
 	return &volume.MountResponse{Mountpoint: vol.MountPoint}, nil
 }
 
-func (d *sshfsDriver) Unmount(r *volume.UnmountRequest) error {
-	log.Debugf("Umount Request %s", r)
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *sshfsDriver) Unmount(r *volume.UnmountRequest) (err error) {
+	logger := requestLogger("unmount", r.Name).WithField("mount_id", r.ID)
+	logger.Debug("Unmount request")
+	defer logRequest(logger, time.Now(), &err)
 
-	vol, ok := d.volumes[r.Name]
+	vol, ok := d.lockVolume(r.Name)
 	if !ok {
 		msg := fmt.Sprintf("Failed to unmount volume %s because it doesn't exists", r.Name)
-		log.Error(msg)
+		logger.Error(msg)
 		return fmt.Errorf(msg)
 	}
+	defer vol.lock.Unlock()
+	logger = volumeLogger(logger, vol)
 
-	vol.RefCount--
-	if vol.RefCount <= 0 {
+	d.mutex.Lock()
+	if !vol.removeMount(r.ID) {
+		d.mutex.Unlock()
+		logger.Warningf("Volume %s is not mounted for %s, ignoring unmount", vol.Name, r.ID)
+		return nil
+	}
+	unused := len(vol.MountIDs) == 0
+	if unused {
+		d.stopSupervisor(vol)
+	}
+	d.mutex.Unlock()
+
+	if unused {
 		if err := d.unmountVolume(vol); err != nil {
+			// Keep the id registered such that the unmount can be retried
+			d.mutex.Lock()
+			vol.addMount(r.ID)
+			d.startSupervisor(vol)
+			d.mutex.Unlock()
 			return err
 		}
-		vol.RefCount = 0
 	}
-	d.saveState()
-	return nil
+	return d.saveState()
 }
 
 func (d *sshfsDriver) Capabilities() *volume.CapabilitiesResponse {
-	log.Debugf("Capabilities Request")
+	requestLogger("capabilities", "").Debug("Capabilities request")
 	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "global"}}
 }
 
 // Helper methods
 
+// describe returns the Docker representation of the volume, including the
+// connection metrics of native mounts.
+// The caller must hold d.mutex.
+func (d *sshfsDriver) describe(vol *sshfsVolume) *volume.Volume {
+	v := vol.toVolume()
+	v.Status["option_policy"] = d.policy.status()
+	if statuser, ok := d.mounter.(mountStatuser); ok {
+		for key, val := range statuser.Status(vol) {
+			v.Status[key] = val
+		}
+	}
+	return v
+}
+
 func (d *sshfsDriver) newVolume(name string) (*sshfsVolume, error) {
 	path := filepath.Join(d.volumePath, name)
 	err := os.MkdirAll(path, VolumeDirMode)
@@ -328,21 +1073,67 @@ func (d *sshfsDriver) newVolume(name string) (*sshfsVolume, error) {
 		CreatedAt:  time.Now().Format(time.RFC3339Nano),
 		Ephemeral:  false,
 		RefCount:   0,
+		MountIDs:   make(map[string]string),
+		lock:       &sync.Mutex{},
 	}
 	return vol, nil
 }
 
+// lockVolume returns the named volume with its lock held, such that
+// operations on the same volume are serialized while other volumes are
+// mounted and unmounted in parallel. The caller must unlock vol.lock.
+func (d *sshfsDriver) lockVolume(name string) (*sshfsVolume, bool) {
+	for {
+		d.mutex.RLock()
+		vol, ok := d.volumes[name]
+		d.mutex.RUnlock()
+		if !ok {
+			return nil, false
+		}
+
+		vol.lock.Lock()
+		// The volume might have been removed or replaced while waiting
+		d.mutex.RLock()
+		current := d.volumes[name]
+		d.mutex.RUnlock()
+		if current == vol {
+			return vol, true
+		}
+		vol.lock.Unlock()
+	}
+}
+
+// discardVolume removes the files of a volume that failed to be created,
+// unless they belong to an existing volume of the same name
+func (d *sshfsDriver) discardVolume(vol *sshfsVolume) {
+	d.mutex.RLock()
+	_, exists := d.volumes[vol.Name]
+	d.mutex.RUnlock()
+	if !exists {
+		d.removeVolume(vol)
+	}
+}
+
 func (d *sshfsDriver) removeVolume(vol *sshfsVolume) error {
-	// Remove the IdentityFile path if it exists
+	// Remove the key file of the volume if it exists
 	if _, err := os.Stat(vol.MountPoint); !os.IsNotExist(err) {
-		if vol.IdentityFile != "" && vol.Ephemeral {
-			if err := os.Remove(vol.IdentityFile); err != nil {
-				msg := fmt.Sprintf("Ephemeral - Failed to remove the volume %s's identity file: %s (%s)", vol.Name, vol.IdentityFile, err)
+		if vol.Ephemeral {
+			if err := os.Remove(vol.keyFile()); err != nil && !os.IsNotExist(err) {
+				msg := fmt.Sprintf("Ephemeral - Failed to remove the volume %s's identity file: %s (%s)", vol.Name, vol.keyFile(), err)
 				log.Error(msg)
 			}
 		}
 	}
 
+	for _, knownHosts := range []string{vol.KnownHostsFile, vol.JumpKnownHostsFile} {
+		if knownHosts == "" {
+			continue
+		}
+		if err := os.Remove(knownHosts); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to remove the volume %s's known_hosts file: %s (%s)", vol.Name, knownHosts, err)
+		}
+	}
+
 	// Remove MountPoint
 	// If the Mountpoint directory exist, remove it
 	if _, err := os.Stat(vol.MountPoint); !os.IsNotExist(err) {
@@ -357,50 +1148,110 @@ func (d *sshfsDriver) removeVolume(vol *sshfsVolume) error {
 	return nil
 }
 
+// mountVolume mounts the volume without holding d.mutex,
+// the caller must hold vol.lock
 func (d *sshfsDriver) mountVolume(vol *sshfsVolume) error {
-	cmd := exec.Command("sshfs", "-oStrictHostKeyChecking=no", vol.SSHCmd, vol.MountPoint)
-
-	if vol.Port != "" {
-		cmd.Args = append(cmd.Args, "-p", vol.Port)
+	d.mutex.RLock()
+	shredded := vol.keyShredded()
+	unopened := vol.unopenedSecrets()
+	d.mutex.RUnlock()
+	if unopened {
+		return fmt.Errorf("the secrets of volume %s can't be opened, %s", vol.Name, errNoSecretKey)
 	}
-
-	if vol.Password != "" {
-		cmd.Args = append(cmd.Args, "-o", "workaround=rename", "-o", "password_stdin")
-		cmd.Stdin = strings.NewReader(vol.Password)
+	key := ""
+	if shredded {
+		var err error
+		if key, err = d.provisionKey(vol); err != nil {
+			return err
+		}
 	}
 
-	if vol.IdentityFile != "" {
-		cmd.Args = append(cmd.Args, "-o", "IdentityFile="+vol.IdentityFile)
+	mount, err := d.prepareMount(vol)
+	if err != nil {
+		return err
+	}
+	// All the steps of the mount share one deadline
+	mount.mountDeadline = time.Now().Add(mount.mountTimeout(d.mountTimeout))
+	if key != "" {
+		// The provisioned key is only used for this mount
+		mount.identityKey = key
+		mount.IdentityFile = mount.keyFile()
+		mount.IdentityKeyFile = ""
 	}
 
-	// Append the rest
-	for _, option := range vol.Options {
-		cmd.Args = append(cmd.Args, "-o", option)
+	if mount.MinFree != "" {
+		if err := d.checkCapacity(mount); err != nil {
+			return err
+		}
 	}
 
-	// Ensure that children have the same process pgid
-	log.Debugf("Executing mount command %v", cmd)
-	output, err := cmd.CombinedOutput()
+	start := time.Now()
+	err = d.mounter.Mount(mount)
+	observeMount(mount.backend(), start, err)
 	if err != nil {
-		return fmt.Errorf("sshfs command failed %v %v (%s)", cmd, err, output)
+		return err
+	}
+	d.mutex.Lock()
+	vol.ConnectedAt = time.Now().Format(time.RFC3339Nano)
+	d.mutex.Unlock()
+
+	if vol.Ephemeral && !shredded {
+		d.shredKey(vol)
 	}
 	return nil
 }
 
-func (d *sshfsDriver) unmountVolume(vol *sshfsVolume) error {
-	cmd := fmt.Sprintf("umount %s", vol.MountPoint)
-	if err := exec.Command("sh", "-c", cmd).Run(); err != nil {
-		return err
+// prepareMount returns the copy of the volume that is passed to the mounter.
+// The caller must hold vol.lock but not d.mutex.
+func (d *sshfsDriver) prepareMount(vol *sshfsVolume) (*sshfsVolume, error) {
+	d.mutex.RLock()
+	current := d.snapshot(vol)
+	d.mutex.RUnlock()
+
+	if current.Profile != "" {
+		resolved, err := d.resolveProfile(current)
+		if err != nil {
+			return nil, err
+		}
+		d.mutex.Lock()
+		applyProfile(vol, resolved)
+		current = d.snapshot(vol)
+		d.mutex.Unlock()
 	}
-	// Check that the mountpoint is empty
-	files, err := ioutil.ReadDir(vol.MountPoint)
+
+	// The policy is applied on every mount such that policy
+	// changes also cover the volumes that already exist
+	options, err := d.policy.apply(current.Options)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	current.Options = options
+	return current, nil
+}
 
-	if len(files) > 0 {
-		return fmt.Errorf("after unmount %d files still exists in %s", len(files), vol.MountPoint)
+// snapshot returns a copy of the volume that the mounter can read
+// while the volume itself is updated. The caller must hold d.mutex.
+func (d *sshfsDriver) snapshot(vol *sshfsVolume) *sshfsVolume {
+	copied := *vol
+	copied.MountIDs = make(map[string]string, len(vol.MountIDs))
+	for id, mountedAt := range vol.MountIDs {
+		copied.MountIDs[id] = mountedAt
 	}
+	return &copied
+}
+
+// unmountVolume unmounts the volume without holding d.mutex,
+// the caller must hold vol.lock
+func (d *sshfsDriver) unmountVolume(vol *sshfsVolume) error {
+	d.mutex.RLock()
+	mount := d.snapshot(vol)
+	d.mutex.RUnlock()
 
+	if err := d.mounter.Unmount(mount); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	vol.ConnectedAt = ""
+	d.mutex.Unlock()
 	return nil
 }
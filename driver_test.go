@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// fakeMounter records mounts in memory instead of mounting over FUSE
+type fakeMounter struct {
+	mutex    sync.Mutex
+	mounted  map[string]bool
+	mounts   int
+	unmounts int
+	mountErr error
+	// Mounts of the volumes in mountErrs fail with their error
+	mountErrs map[string]error
+	// The volume of the last successful mount
+	last *sshfsVolume
+	// Mounts of the volumes in hold block until their channel is closed
+	hold map[string]chan struct{}
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{mounted: make(map[string]bool)}
+}
+
+func (m *fakeMounter) Mount(vol *sshfsVolume) error {
+	m.mutex.Lock()
+	hold := m.hold[vol.Name]
+	m.mutex.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.mountErr != nil {
+		return m.mountErr
+	}
+	if err := m.mountErrs[vol.Name]; err != nil {
+		return err
+	}
+	if m.mounted[vol.Name] {
+		return fmt.Errorf("volume %s is already mounted", vol.Name)
+	}
+	m.mounted[vol.Name] = true
+	m.mounts++
+	m.last = vol
+	return nil
+}
+
+func (m *fakeMounter) Unmount(vol *sshfsVolume) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.mounted[vol.Name] {
+		return fmt.Errorf("volume %s is not mounted", vol.Name)
+	}
+	delete(m.mounted, vol.Name)
+	m.unmounts++
+	return nil
+}
+
+func (m *fakeMounter) Detach(vol *sshfsVolume) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.mounted, vol.Name)
+	return nil
+}
+
+func (m *fakeMounter) Check(vol *sshfsVolume) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.mounted[vol.Name] {
+		return fmt.Errorf("volume %s is not mounted", vol.Name)
+	}
+	return nil
+}
+
+func (m *fakeMounter) isMounted(name string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mounted[name]
+}
+
+func testSecretStore(t *testing.T) secretStore {
+	store, err := newAESGCMStore(bytes.Repeat([]byte{0x42}, SecretKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func newTestDriver(t *testing.T, basePath string, mounter Mounter) *sshfsDriver {
+	return startTestDriver(t, basePath, testSecretStore(t), mounter)
+}
+
+// startTestDriver creates the driver and reconciles its volumes like main does
+func startTestDriver(t *testing.T, basePath string, secrets secretStore, mounter Mounter) *sshfsDriver {
+	d, err := newSshfsDriver(basePath, secrets, mounter, driverConfig{Policy: newOptionPolicy()})
+	if err != nil {
+		t.Fatalf("Failed to create the driver: %s", err)
+	}
+	if err := d.reconcile(MountInfoPath); err != nil {
+		t.Fatalf("Failed to reconcile the driver: %s", err)
+	}
+	return d
+}
+
+func createTestVolume(t *testing.T, d *sshfsDriver, name string, options map[string]string) {
+	if options == nil {
+		options = map[string]string{"sshcmd": "user@host:/data", "password": "secret"}
+	}
+	if err := d.Create(&volume.CreateRequest{Name: name, Options: options}); err != nil {
+		t.Fatalf("Failed to create volume %s: %s", name, err)
+	}
+}
+
+func TestSetupOptions(t *testing.T) {
+	key := testPrivateKey(t, "")
+	tests := []struct {
+		name    string
+		options map[string]string
+		err     string
+	}{
+		{"password", map[string]string{"sshcmd": "u@h:/p", "password": "pw"}, ""},
+		{"identity file", map[string]string{"sshcmd": "u@h:/p", "identity_file": "/root/.ssh/id_rsa"}, ""},
+		{"id_rsa", map[string]string{"sshcmd": "u@h:/p", "id_rsa": key}, ""},
+		{"ssh_key", map[string]string{"sshcmd": "u@h:/p", "ssh_key": key}, ""},
+		{"invalid ssh_key", map[string]string{"sshcmd": "u@h:/p", "ssh_key": "KEY"}, "invalid 'ssh_key' option"},
+		{"missing sshcmd", map[string]string{"password": "pw"}, "'sshcmd' option required"},
+		{"missing credentials", map[string]string{"sshcmd": "u@h:/p"}, "must be set"},
+		{"password and key", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "identity_file": "/k"}, "mutually exclusive"},
+		{"two keys", map[string]string{"sshcmd": "u@h:/p", "id_rsa": key, "identity_file": "/k"}, "mutually exclusive"},
+		{"invalid ephemeral", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "ephemeral": "maybe"}, "invalid syntax"},
+		{"invalid host key checking", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "strict_host_key_checking": "sometimes"}, "must be one of"},
+		{"fingerprint without checking", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "host_key_fingerprint": "SHA256:abc", "strict_host_key_checking": "no"}, "requires"},
+		{"invalid backend", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "backend": "nfs"}, "'backend' must be"},
+		{"native unsupported option", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "backend": "native", "cache": "yes"}, "not supported by the native backend"},
+		{"password file outside secrets", map[string]string{"sshcmd": "u@h:/p", "password_file": "/etc/passwd"}, "must be inside"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+			err := vol.setupOptions(test.options)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSetupOptionsPassThrough(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{
+		"sshcmd":      "u@h:/p",
+		"password":    "pw",
+		"allow_other": "",
+		"Compression": "no",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := strings.Join(vol.Options, ",")
+	if !strings.Contains(options, "allow_other") || !strings.Contains(options, "Compression=no") {
+		t.Fatalf("Expected the pass-through options, got %v", vol.Options)
+	}
+	if vol.StrictHostKeyChecking != StrictHostKeyCheckingNo {
+		t.Fatalf("Expected no host key checking by default, got %s", vol.StrictHostKeyChecking)
+	}
+}
+
+func TestMountRefCounting(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	createTestVolume(t, d, "vol", nil)
+
+	for _, id := range []string{"a", "b", "a"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatalf("Failed to mount for %s: %s", id, err)
+		}
+	}
+	if mounter.mounts != 1 {
+		t.Fatalf("Expected a single mount, got %d", mounter.mounts)
+	}
+	if d.volumes["vol"].RefCount != 2 {
+		t.Fatalf("Expected a refcount of 2, got %d", d.volumes["vol"].RefCount)
+	}
+
+	// Unknown and duplicate unmounts must not skew the refcount
+	for _, id := range []string{"unknown", "a", "a"} {
+		if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatalf("Failed to unmount for %s: %s", id, err)
+		}
+	}
+	if !mounter.isMounted("vol") || d.volumes["vol"].RefCount != 1 {
+		t.Fatalf("Expected the volume to stay mounted for b, refcount %d", d.volumes["vol"].RefCount)
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if mounter.isMounted("vol") || mounter.unmounts != 1 {
+		t.Fatalf("Expected the volume to be unmounted once, got %d unmounts", mounter.unmounts)
+	}
+}
+
+func TestMountFailure(t *testing.T) {
+	mounter := newFakeMounter()
+	mounter.mountErr = fmt.Errorf("connection refused")
+	d := newTestDriver(t, t.TempDir(), mounter)
+	createTestVolume(t, d, "vol", nil)
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err == nil {
+		t.Fatal("Expected the mount to fail")
+	}
+	vol := d.volumes["vol"]
+	if vol.RefCount != 0 || len(vol.MountIDs) != 0 {
+		t.Fatalf("Expected no mounts after a failure, got %v", vol.MountIDs)
+	}
+	if !strings.Contains(vol.LastError, "connection refused") {
+		t.Fatalf("Expected the mount error to be recorded, got %q", vol.LastError)
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{
+		"sshcmd":      "user@host:/data",
+		"password":    "secret",
+		"known_hosts": "host ssh-ed25519 AAAA",
+		"port":        "not-a-port",
+	}})
+	if err == nil {
+		t.Fatal("Expected the invalid port to be rejected")
+	}
+	if _, ok := d.volumes["vol"]; ok {
+		t.Fatal("Expected the volume not to be created")
+	}
+	leftovers, err := filepath.Glob(filepath.Join(d.volumePath, "vol*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) > 0 {
+		t.Fatalf("Expected the files of the failed volume to be removed, found %v", leftovers)
+	}
+
+	// The name of an existing volume is rejected without touching its files or mounts
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":      "user@host:/data",
+		"password":    "secret",
+		"known_hosts": "host ssh-ed25519 AAAA",
+	})
+	existing := d.volumes["vol"]
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []map[string]string{
+		{"sshcmd": "invalid"},
+		{"sshcmd": "other@host:/data", "password": "other", "known_hosts": "host ssh-ed25519 BBBB"},
+	} {
+		err := d.Create(&volume.CreateRequest{Name: "vol", Options: options})
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("Expected the existing name to be rejected, got %v", err)
+		}
+	}
+	if d.volumes["vol"] != existing || len(existing.MountIDs) != 1 || existing.SSHCmd != "user@host:/data" {
+		t.Fatalf("Expected the existing volume to be kept, got %+v", d.volumes["vol"])
+	}
+	if _, err := os.Stat(existing.MountPoint); err != nil {
+		t.Fatalf("Expected the existing volume to keep its mountpoint (%s)", err)
+	}
+	knownHosts, err := ioutil.ReadFile(existing.KnownHostsFile)
+	if err != nil || !strings.Contains(string(knownHosts), "AAAA") {
+		t.Fatalf("Expected the existing volume to keep its known_hosts, got %q (%v)", knownHosts, err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	createTestVolume(t, d, "vol", nil)
+	mountPoint := d.volumes["vol"].MountPoint
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err == nil {
+		t.Fatal("Expected removing a mounted volume to fail")
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.volumes["vol"]; ok {
+		t.Fatal("Expected the volume to be forgotten")
+	}
+	if _, err := os.Stat(mountPoint); !os.IsNotExist(err) {
+		t.Fatalf("Expected the mountpoint %s to be removed", mountPoint)
+	}
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err == nil {
+		t.Fatal("Expected removing an unknown volume to fail")
+	}
+}
+
+func TestGetAndList(t *testing.T) {
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", nil)
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.CreatedAt == "" || res.Volume.Status["state"] != "mounted" || res.Volume.Status["auth_method"] != "password" {
+		t.Fatalf("Unexpected volume status %v", res.Volume.Status)
+	}
+	if strings.Contains(fmt.Sprint(res.Volume.Status), "secret") {
+		t.Fatalf("The status must not contain the password: %v", res.Volume.Status)
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Volumes) != 1 || list.Volumes[0].Name != "vol" {
+		t.Fatalf("Unexpected volumes %v", list.Volumes)
+	}
+
+	if _, err := d.Get(&volume.GetRequest{Name: "missing"}); err == nil {
+		t.Fatal("Expected getting an unknown volume to fail")
+	}
+}
+
+func TestAuthMethod(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	key := testPrivateKey(t, "")
+	methods := map[string]string{
+		"password":       "password",
+		"identity_file":  "identity_file",
+		"id_rsa":         "id_rsa",
+		"ssh_key":        "ssh_key",
+		"key_passphrase": "ssh_key with passphrase",
+	}
+	for name, options := range map[string]map[string]string{
+		"password":       {"sshcmd": "u@h:/p", "password": "pw"},
+		"identity_file":  {"sshcmd": "u@h:/p", "identity_file": "/root/.ssh/id_rsa"},
+		"id_rsa":         {"sshcmd": "u@h:/p", "id_rsa": key},
+		"ssh_key":        {"sshcmd": "u@h:/p", "ssh_key": key},
+		"key_passphrase": {"sshcmd": "u@h:/p", "ssh_key": testPrivateKey(t, "hunter2"), "key_passphrase": "hunter2"},
+	} {
+		createTestVolume(t, d, name, options)
+	}
+
+	// The method is kept in the state, and without the secret key to open it
+	for _, d := range []*sshfsDriver{d, newTestDriver(t, basePath, newFakeMounter()),
+		startTestDriver(t, basePath, missingSecretStore{}, newFakeMounter())} {
+		for name, method := range methods {
+			res, err := d.Get(&volume.GetRequest{Name: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Volume.Status["auth_method"] != method {
+				t.Errorf("Expected volume %s to authenticate with %q, got %q", name, method, res.Volume.Status["auth_method"])
+			}
+		}
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	createTestVolume(t, d, "vol", nil)
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(d.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("The state must not contain the cleartext password: %s", data)
+	}
+
+	// A restarted plugin remounts the volumes that are in use
+	mounter := newFakeMounter()
+	restarted := newTestDriver(t, basePath, mounter)
+	vol, ok := restarted.volumes["vol"]
+	if !ok {
+		t.Fatal("Expected the volume to be restored")
+	}
+	if vol.Password != "secret" {
+		t.Fatalf("Expected the password to be restored, got %q", vol.Password)
+	}
+	if _, ok := vol.MountIDs["a"]; !ok || vol.RefCount != 1 {
+		t.Fatalf("Expected the mount ids to be restored, got %v", vol.MountIDs)
+	}
+	if !mounter.isMounted("vol") {
+		t.Fatal("Expected the volume to be remounted on startup")
+	}
+}
+
+func TestLegacyStateMigration(t *testing.T) {
+	basePath := t.TempDir()
+	statePath := filepath.Join(basePath, "state", "sshfs-state.json")
+	legacy := `{"vol":{"Name":"vol","MountPoint":"` + filepath.Join(basePath, "volumes", "vol") +
+		`","SSHCmd":"u@h:/p","Password":"cleartext","RefCount":0}}`
+	if err := os.MkdirAll(filepath.Dir(statePath), VolumeDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(statePath, []byte(legacy), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, basePath, newFakeMounter())
+	if d.volumes["vol"].Password != "cleartext" {
+		t.Fatal("Expected the legacy password to be loaded")
+	}
+
+	for _, path := range []string{statePath, backupPath(statePath)} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("cleartext")) {
+			t.Fatalf("Expected %s to no longer contain the cleartext password: %s", path, data)
+		}
+		if !bytes.Contains(data, []byte(`"version":1`)) {
+			t.Fatalf("Expected %s to be migrated to version 1: %s", path, data)
+		}
+	}
+}
+
+func TestCorruptStateUsesBackup(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	createTestVolume(t, d, "first", nil)
+	createTestVolume(t, d, "second", nil)
+
+	if err := ioutil.WriteFile(d.statePath, []byte(`{"version":1,"volu`), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newTestDriver(t, basePath, newFakeMounter())
+	if _, ok := restarted.volumes["first"]; !ok {
+		t.Fatal("Expected the volumes to be restored from the backup")
+	}
+}
+
+func TestSplitSSHCmd(t *testing.T) {
+	tests := []struct {
+		cmd, user, host, path string
+	}{
+		{"user@host:/data", "user", "host", "/data"},
+		{"host:data", "", "host", "data"},
+		{"user@host:", "user", "host", ""},
+		{"user@[::1]:/data", "user", "::1", "/data"},
+		{"user@host:/data/a@b:c", "user", "host", "/data/a@b:c"},
+	}
+	for _, test := range tests {
+		user, host, path := splitSSHCmd(test.cmd)
+		if user != test.user || host != test.host || path != test.path {
+			t.Errorf("splitSSHCmd(%q) = %q, %q, %q, want %q, %q, %q",
+				test.cmd, user, host, path, test.user, test.host, test.path)
+		}
+	}
+}
+
+func TestReadMountInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	content := "22 1 0:21 / / rw - ext4 /dev/root rw\n" +
+		"40 22 0:35 / /mnt/volumes/my\\040vol rw,nosuid - fuse.sshfs user@host:/data rw\n"
+	if err := ioutil.WriteFile(path, []byte(content), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := readMountInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsType, ok := mounts["/mnt/volumes/my vol"]; !ok || fsType != "fuse.sshfs" {
+		t.Fatalf("Expected the escaped sshfs mount, got %v", mounts)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	basePath := t.TempDir()
+	bootID := filepath.Join(t.TempDir(), "boot_id")
+	if err := ioutil.WriteFile(bootID, []byte("first-boot\n"), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	config := driverConfig{Policy: newOptionPolicy(), BootIDPath: bootID}
+	start := func(mounter Mounter) *sshfsDriver {
+		d, err := newSshfsDriver(basePath, testSecretStore(t), mounter, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := start(newFakeMounter())
+	if err := d.reconcile(MountInfoPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"used", "unused", "failing"} {
+		createTestVolume(t, d, name, nil)
+	}
+	for _, name := range []string{"used", "failing"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: name, ID: "c1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// After a restart, only the unused volume is still mounted
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	content := "22 1 0:21 / / rw - ext4 /dev/root rw\n" +
+		"40 22 0:35 / " + d.volumes["unused"].MountPoint + " rw - fuse.sshfs user@host:/data rw\n"
+	if err := ioutil.WriteFile(mountInfo, []byte(content), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	mounter := newFakeMounter()
+	mounter.mounted["unused"] = true
+	mounter.mountErrs = map[string]error{"failing": fmt.Errorf("unreachable")}
+	d = start(mounter)
+
+	// Requests for a volume wait until it is reconciled
+	mounted := make(chan error)
+	go func() {
+		_, err := d.Mount(&volume.MountRequest{Name: "used", ID: "c2"})
+		mounted <- err
+	}()
+	select {
+	case <-mounted:
+		t.Fatal("Expected the mount to wait for reconcile")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := d.reconcile(mountInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-mounted; err != nil {
+		t.Fatal(err)
+	}
+
+	if !mounter.isMounted("used") || len(d.volumes["used"].MountIDs) != 2 {
+		t.Fatalf("Expected the used volume to be remounted, got %v", d.volumes["used"].MountIDs)
+	}
+	if mounter.isMounted("unused") {
+		t.Fatal("Expected the unused volume to be unmounted")
+	}
+	if len(d.volumes["failing"].MountIDs) != 0 {
+		t.Fatalf("Expected the mounts of a failed remount to be reset, got %v", d.volumes["failing"].MountIDs)
+	}
+
+	// After a reboot, the mounts of the previous boot are forgotten
+	if err := ioutil.WriteFile(bootID, []byte("second-boot\n"), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	mounter = newFakeMounter()
+	d = start(mounter)
+	if err := d.reconcile(mountInfo); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.volumes["used"].MountIDs) != 0 || mounter.mounts != 0 {
+		t.Fatalf("Expected no remounts after a reboot, got %v", d.volumes["used"].MountIDs)
+	}
+	if err := d.Remove(&volume.RemoveRequest{Name: "used"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentMounts(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	for _, name := range []string{"slow", "fast"} {
+		createTestVolume(t, d, name, nil)
+	}
+
+	// A hanging mount must only block its own volume
+	hold := make(chan struct{})
+	mounter.hold = map[string]chan struct{}{"slow": hold}
+	slowDone := make(chan error)
+	go func() {
+		_, err := d.Mount(&volume.MountRequest{Name: "slow", ID: "a"})
+		slowDone <- err
+	}()
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "fast", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.List(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(&volume.GetRequest{Name: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+	createTestVolume(t, d, "other", nil)
+	if err := d.Remove(&volume.RemoveRequest{Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-slowDone:
+		t.Fatalf("Expected the slow mount to still be pending, got %v", err)
+	default:
+	}
+
+	close(hold)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+	if !mounter.isMounted("slow") || !mounter.isMounted("fast") {
+		t.Fatal("Expected both volumes to be mounted")
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	names := []string{"vol1", "vol2", "vol3"}
+	for _, name := range names {
+		createTestVolume(t, d, name, nil)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for _, name := range names {
+			wg.Add(1)
+			go func(name, id string) {
+				defer wg.Done()
+				if _, err := d.Mount(&volume.MountRequest{Name: name, ID: id}); err != nil {
+					t.Errorf("Failed to mount %s for %s: %s", name, id, err)
+					return
+				}
+				d.List()
+				d.Get(&volume.GetRequest{Name: name})
+				d.Path(&volume.PathRequest{Name: name})
+				if err := d.Unmount(&volume.UnmountRequest{Name: name, ID: id}); err != nil {
+					t.Errorf("Failed to unmount %s for %s: %s", name, id, err)
+				}
+			}(name, fmt.Sprintf("id%d", i))
+		}
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		if mounter.isMounted(name) || d.volumes[name].RefCount != 0 {
+			t.Errorf("Expected %s to be unmounted, refcount %d", name, d.volumes[name].RefCount)
+		}
+	}
+	if mounter.mounts != mounter.unmounts {
+		t.Fatalf("Expected every mount to be unmounted, got %d mounts and %d unmounts", mounter.mounts, mounter.unmounts)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KeyHookTimeout bounds how long the key provisioning hook may run
+const KeyHookTimeout = 30 * time.Second
+
+// shredFile overwrites the file with random data before removing it,
+// such that the key can't be recovered from the freed blocks
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, rand.Reader, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// keyShredded reports whether the volume's ephemeral key has been removed.
+// The caller must hold d.mutex.
+func (v *sshfsVolume) keyShredded() bool {
+	return v.Ephemeral && v.KeyShreddedAt != ""
+}
+
+// shredKey removes the ephemeral key of the volume from disk and memory
+// once it has been mounted. Only the key file that the plugin writes next
+// to the mountpoint is shredded. The caller must hold vol.lock.
+func (d *sshfsDriver) shredKey(vol *sshfsVolume) {
+	path := vol.keyFile()
+	if err := shredFile(path); err != nil {
+		log.Errorf("Ephemeral - Failed to shred the volume %s's key %s (%s)", vol.Name, path, err)
+	}
+
+	d.mutex.Lock()
+	vol.identityKey = ""
+	vol.SealedIdentityKey = ""
+	vol.KeyShreddedAt = time.Now().Format(time.RFC3339Nano)
+	d.mutex.Unlock()
+	log.Infof("Ephemeral - Shredded the key of volume %s after its first mount", vol.Name)
+}
+
+// provisionKey runs the key hook to get a new private key for a volume
+// whose ephemeral key has been shredded
+func (d *sshfsDriver) provisionKey(vol *sshfsVolume) (string, error) {
+	if d.keyHook == "" {
+		return "", fmt.Errorf("the ephemeral key of volume %s was removed after its first mount, "+
+			"recreate the volume or configure EPHEMERAL_KEY_HOOK to mount it again", vol.Name)
+	}
+
+	d.mutex.RLock()
+	sshcmd := vol.SSHCmd
+	d.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), KeyHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, d.keyHook, vol.Name)
+	cmd.Env = append(os.Environ(), "VOLUME_NAME="+vol.Name, "VOLUME_SSHCMD="+sshcmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("the key hook %s failed for volume %s (%s: %s)",
+			d.keyHook, vol.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	key := string(output)
+	if strings.TrimSpace(key) == "" {
+		return "", fmt.Errorf("the key hook %s returned no key for volume %s", d.keyHook, vol.Name)
+	}
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	log.Infof("Ephemeral - Provisioned a new key for volume %s", vol.Name)
+	return key, nil
+}
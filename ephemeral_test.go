@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestShredFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte("PRIVATE KEY"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := shredFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to be removed, got %v", err)
+	}
+	if err := shredFile(path); err != nil {
+		t.Fatalf("Expected a missing file to be ignored, got %s", err)
+	}
+}
+
+func TestEphemeralRequiresKey(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{"sshcmd": "u@h:/p", "password": "pw", "ephemeral": "true"})
+	if err == nil || !strings.Contains(err.Error(), "requires a key") {
+		t.Fatalf("Expected an ephemeral password volume to be rejected, got %v", err)
+	}
+}
+
+func TestEphemeralKeyShreddedAfterMount(t *testing.T) {
+	basePath := t.TempDir()
+	mounter := newFakeMounter()
+	d := newTestDriver(t, basePath, mounter)
+	key := testPrivateKey(t, "")
+	createTestVolume(t, d, "vol", map[string]string{"sshcmd": "user@host:/data", "id_rsa": key, "ephemeral": "true"})
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	vol := d.volumes["vol"]
+	if mounter.last.identityKey != key {
+		t.Fatalf("Expected the first mount to use the key, got %q", mounter.last.identityKey)
+	}
+	if vol.identityKey != "" || vol.KeyShreddedAt == "" {
+		t.Fatalf("Expected the key to be shredded after the first mount, got %+v", vol)
+	}
+	state, err := ioutil.ReadFile(d.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(state), "SealedIdentityKey") {
+		t.Fatalf("Expected the key not to be persisted, got %s", state)
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Mount(&volume.MountRequest{Name: "vol", ID: "b"})
+	if err == nil || !strings.Contains(err.Error(), "removed after its first mount") {
+		t.Fatalf("Expected a later mount to fail, got %v", err)
+	}
+
+	// The shredded volume is loaded again after a restart
+	newTestDriver(t, basePath, newFakeMounter())
+}
+
+func TestEphemeralRejectsKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { credentialDirs = dirs }(credentialDirs)
+	credentialDirs = []string{dir}
+	key := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(key, []byte(testPrivateKey(t, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	for _, option := range []string{"identity_file", "id_rsa_file"} {
+		err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{
+			"sshcmd": "user@host:/data", option: key, "ephemeral": "true"}})
+		if err == nil || !strings.Contains(err.Error(), "not shredded") {
+			t.Fatalf("Expected an ephemeral %s to be rejected, got %v", option, err)
+		}
+	}
+	if _, err := os.Stat(key); err != nil {
+		t.Fatalf("Expected the operator's key file to be kept, got %v", err)
+	}
+}
+
+func TestEphemeralKeyHook(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	hook := filepath.Join(t.TempDir(), "hook")
+	script := "#!/bin/sh\necho \"NEW KEY FOR $1 $VOLUME_SSHCMD\"\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d.keyHook = hook
+	createTestVolume(t, d, "vol", map[string]string{"sshcmd": "user@host:/data", "id_rsa": testPrivateKey(t, ""), "ephemeral": "true"})
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mounter.last.identityKey != "NEW KEY FOR vol user@host:/data\n" {
+		t.Fatalf("Expected the provisioned key to be used, got %q", mounter.last.identityKey)
+	}
+	if d.volumes["vol"].identityKey != "" {
+		t.Fatal("Expected the provisioned key not to be kept")
+	}
+
+	d.keyHook = "/bin/false"
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c"}); err == nil || !strings.Contains(err.Error(), "key hook") {
+		t.Fatalf("Expected a failing hook to fail the mount, got %v", err)
+	}
+}
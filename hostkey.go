@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// HostKeyScanTimeout bounds how long fetching a server's host key may take
+	HostKeyScanTimeout = 10 * time.Second
+	// DefaultSSHPort is used when the volume doesn't specify a port
+	DefaultSSHPort = "22"
+)
+
+// Accepted values of the strict_host_key_checking option
+const (
+	StrictHostKeyCheckingYes       = "yes"
+	StrictHostKeyCheckingAcceptNew = "accept-new"
+	StrictHostKeyCheckingNo        = "no"
+)
+
+// errHostKeyFetched aborts the handshake once the host key has been recorded
+var errHostKeyFetched = fmt.Errorf("host key fetched")
+
+// hostKeyAlgorithms are the host key algorithms of each key type. A server
+// presents only one of its host keys per connection, so a pinned key is
+// searched for by asking for each type in turn.
+var hostKeyAlgorithms = [][]string{
+	{ssh.KeyAlgoED25519},
+	{ssh.KeyAlgoECDSA256},
+	{ssh.KeyAlgoECDSA384},
+	{ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+func validStrictHostKeyChecking(val string) bool {
+	switch val {
+	case StrictHostKeyCheckingYes, StrictHostKeyCheckingAcceptNew, StrictHostKeyCheckingNo:
+		return true
+	}
+	return false
+}
+
+// normalizeFingerprint returns the fingerprint in the 'SHA256:<base64>' form
+// produced by ssh-keygen -l, which allows it to be passed without the prefix
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if strings.HasPrefix(fingerprint, "MD5:") {
+		return "", fmt.Errorf("only SHA256 host key fingerprints are supported")
+	}
+	fingerprint = strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "=")
+	if fingerprint == "" {
+		return "", fmt.Errorf("'host_key_fingerprint' can't be empty")
+	}
+	return "SHA256:" + fingerprint, nil
+}
+
+// sshAddress returns the host:port that the volume's sshcmd connects to
+func (v *sshfsVolume) sshAddress() string {
+	_, host, _ := splitSSHCmd(v.SSHCmd)
+	port := v.Port
+	if port == "" {
+		port = DefaultSSHPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (v *sshfsVolume) saveKnownHosts(content string) error {
+	return saveKnownHostsFile(v.KnownHostsFile, content)
+}
+
+func saveKnownHostsFile(path string, content string) error {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), VolumeFileMode); err != nil {
+		msg := fmt.Sprintf("Failed to create the known_hosts file at %s (%s)", path, err)
+		log.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	return nil
+}
+
+// createKnownHosts creates an empty known_hosts file for the volume,
+// keeping the host keys of an existing file
+func (v *sshfsVolume) createKnownHosts() error {
+	return createKnownHostsFile(v.KnownHostsFile)
+}
+
+func createKnownHostsFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, VolumeFileMode)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to create the known_hosts file at %s (%s)", path, err)
+		log.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	return f.Close()
+}
+
+// fetchHostKey connects to the volume's server, through its jump host if
+// it has one, and returns its host key of one of the algorithms without
+// authenticating. It takes at most HostKeyScanTimeout and ends by the deadline.
+func (v *sshfsVolume) fetchHostKey(algorithms []string, deadline time.Time) (ssh.PublicKey, error) {
+	if scan := time.Now().Add(HostKeyScanTimeout); scan.Before(deadline) {
+		deadline = scan
+	}
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User: "sshfs",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyFetched
+		},
+		HostKeyAlgorithms: algorithms,
+		Timeout:           time.Until(deadline),
+	}
+	conn, jumpClient, err := v.dialServer(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the host key of %s (%s)", v.sshAddress(), err)
+	}
+	if jumpClient != nil {
+		defer jumpClient.Close()
+	}
+	defer conn.Close()
+
+	timer := time.AfterFunc(time.Until(deadline), func() { conn.Close() })
+	clientConn, _, _, err := ssh.NewClientConn(conn, v.sshAddress(), config)
+	timer.Stop()
+	if clientConn != nil {
+		clientConn.Close()
+	}
+	if hostKey == nil {
+		return nil, fmt.Errorf("failed to fetch the host key of %s (%v)", v.sshAddress(), err)
+	}
+	return hostKey, nil
+}
+
+// findPinnedHostKey returns the server's host key that matches the volume's
+// HostKeyFingerprint, and the host key algorithms that select it.
+// The server is asked for each type of key until the deadline.
+func (v *sshfsVolume) findPinnedHostKey(deadline time.Time) (ssh.PublicKey, []string, error) {
+	var presented []string
+	var lastErr error
+	for _, algorithms := range hostKeyAlgorithms {
+		if !time.Now().Before(deadline) {
+			return nil, nil, fmt.Errorf("failed to fetch the host key of %s (timed out)", v.sshAddress())
+		}
+		hostKey, err := v.fetchHostKey(algorithms, deadline)
+		if err != nil {
+			// The server has no host key of this type
+			lastErr = err
+			continue
+		}
+		fingerprint := ssh.FingerprintSHA256(hostKey)
+		if fingerprint == v.HostKeyFingerprint {
+			return hostKey, algorithms, nil
+		}
+		presented = append(presented, fingerprint)
+	}
+	if len(presented) == 0 {
+		return nil, nil, lastErr
+	}
+	return nil, nil, fmt.Errorf("host key verification failed for %s, expected %s but the server presented %s",
+		v.sshAddress(), v.HostKeyFingerprint, strings.Join(presented, ", "))
+}
+
+// pinHostKey verifies that the server has the host key matching the
+// volume's HostKeyFingerprint and records it in the volume's known_hosts file
+func (v *sshfsVolume) pinHostKey(deadline time.Time) error {
+	hostKey, _, err := v.findPinnedHostKey(deadline)
+	if err != nil {
+		return err
+	}
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+
+	known, err := ioutil.ReadFile(v.KnownHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(v.sshAddress())}, hostKey)
+	if bytes.Contains(known, []byte(line)) {
+		return nil
+	}
+
+	log.Debugf("Adding pinned host key %s for %s to %s", fingerprint, v.sshAddress(), v.KnownHostsFile)
+	f, err := os.OpenFile(v.KnownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, VolumeFileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testHostKeys(t *testing.T) (ecdsaKey ssh.Signer, ed25519Key ssh.Signer) {
+	ecdsaPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecdsaKey, err = ssh.NewSignerFromKey(ecdsaPrivate); err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ed25519Key, err = ssh.NewSignerFromKey(edPrivate); err != nil {
+		t.Fatal(err)
+	}
+	return ecdsaKey, ed25519Key
+}
+
+func TestPinnedHostKeyOfSeveral(t *testing.T) {
+	ecdsaKey, ed25519Key := testHostKeys(t)
+	address := testSSHServerWithKeys(t, "secret", []ssh.Signer{ecdsaKey, ed25519Key})
+	host, port, _ := net.SplitHostPort(address)
+
+	for _, pinned := range []ssh.Signer{ed25519Key, ecdsaKey} {
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		err := vol.setupOptions(map[string]string{
+			"sshcmd":               "user@" + host + ":/data",
+			"port":                 port,
+			"password":             "secret",
+			"host_key_fingerprint": ssh.FingerprintSHA256(pinned.PublicKey()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vol.pinHostKey(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("Expected the %s host key to be found, got %s", pinned.PublicKey().Type(), err)
+		}
+		client, err := vol.dialSSH(time.Second)
+		if err != nil {
+			t.Fatalf("Expected to connect with the pinned %s host key, got %s", pinned.PublicKey().Type(), err)
+		}
+		client.Close()
+	}
+
+	other, _ := testHostKeys(t)
+	vol := &sshfsVolume{
+		Name:                  "vol",
+		SSHCmd:                "user@" + host + ":/data",
+		Port:                  port,
+		Password:              "secret",
+		KnownHostsFile:        filepath.Join(t.TempDir(), "known_hosts"),
+		HostKeyFingerprint:    ssh.FingerprintSHA256(other.PublicKey()),
+		StrictHostKeyChecking: StrictHostKeyCheckingYes,
+	}
+	err := vol.pinHostKey(time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), ssh.FingerprintSHA256(ecdsaKey.PublicKey())) ||
+		!strings.Contains(err.Error(), ssh.FingerprintSHA256(ed25519Key.PublicKey())) {
+		t.Fatalf("Expected a mismatch listing both host keys, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProxyJumpCommand is the argument that runs the plugin binary as the
+// ProxyCommand of sshfs, connecting to the server through the jump host
+const ProxyJumpCommand = "proxy-jump"
+
+// The environment of the proxy-jump command
+const (
+	jumpEnvAddress    = "SSHFS_JUMP_ADDRESS"
+	jumpEnvUser       = "SSHFS_JUMP_USER"
+	jumpEnvIdentity   = "SSHFS_JUMP_IDENTITY"
+	jumpEnvKnownHosts = "SSHFS_JUMP_KNOWN_HOSTS"
+	jumpEnvStrict     = "SSHFS_JUMP_STRICT_HOST_KEY_CHECKING"
+	jumpEnvTimeout    = "SSHFS_JUMP_TIMEOUT"
+)
+
+// setupJump validates the jump host options of the volume.
+// It is called by setupOptions once all options are set.
+func (v *sshfsVolume) setupJump() error {
+	if v.JumpHost == "" {
+		if v.JumpPort != "" || v.JumpUser != "" || v.JumpIdentityFile != "" || v.jumpPassword != "" {
+			return fmt.Errorf("the 'jump_port', 'jump_user', 'jump_identity' and 'jump_password' options require 'jump_host'")
+		}
+		return nil
+	}
+
+	target := sshTarget{User: v.JumpUser, Host: v.JumpHost}
+	if _, err := parseSSHCmd(target.String()); err != nil {
+		return fmt.Errorf("invalid 'jump_host' or 'jump_user' option, %s", err)
+	}
+	if v.JumpPort != "" {
+		if err := validatePort(v.JumpPort); err != nil {
+			return fmt.Errorf("invalid 'jump_port' option, %s", err)
+		}
+	}
+	if v.JumpIdentityFile != "" && v.jumpPassword != "" {
+		return fmt.Errorf("'jump_identity' and 'jump_password' options are mutually exclusive")
+	}
+	if v.JumpIdentityFile == "" && v.jumpPassword == "" {
+		return fmt.Errorf("either 'jump_identity' or 'jump_password' option must be set with 'jump_host'")
+	}
+	if v.jumpPassword != "" && v.backend() != BackendNative {
+		// The ssh of the exec backend runs the ProxyCommand in a process
+		// of its own, which could only get the password from its environment
+		return fmt.Errorf("'jump_password' requires 'backend=%s', use 'jump_identity' with the %s backend", BackendNative, BackendExec)
+	}
+
+	// The jump host's keys are checked like the server's,
+	// but kept in a known_hosts file of their own
+	if v.StrictHostKeyChecking != StrictHostKeyCheckingNo && v.JumpKnownHostsFile == "" {
+		v.JumpKnownHostsFile = v.MountPoint + "_jump_known_hosts"
+		if err := createKnownHostsFile(v.JumpKnownHostsFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jumpVolume describes the jump host as a volume,
+// such that it is connected to like any other server
+func (v *sshfsVolume) jumpVolume() *sshfsVolume {
+	user := v.JumpUser
+	if user == "" {
+		user = v.sshUser()
+	}
+	return &sshfsVolume{
+		Name:                  v.Name + "-jump",
+		MountPoint:            v.MountPoint + "_jump",
+		SSHCmd:                sshTarget{User: user, Host: v.JumpHost}.String(),
+		Port:                  v.JumpPort,
+		IdentityFile:          v.JumpIdentityFile,
+		Password:              v.jumpPassword,
+		KnownHostsFile:        v.JumpKnownHostsFile,
+		StrictHostKeyChecking: v.StrictHostKeyChecking,
+	}
+}
+
+// jumpStatus describes the jump host in the volume status
+func (v *sshfsVolume) jumpStatus() string {
+	if v.JumpHost == "" {
+		return ""
+	}
+	jump := v.jumpVolume()
+	return jump.sshUser() + "@" + jump.sshAddress()
+}
+
+// proxyJumpArgs returns the sshfs options and environment that make ssh
+// connect through the jump host with the plugin binary as its ProxyCommand
+func (v *sshfsVolume) proxyJumpArgs(timeout time.Duration) ([]string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find the plugin binary for the jump host (%s)", err)
+	}
+	jump := v.jumpVolume()
+	if jump.Password != "" {
+		return nil, nil, fmt.Errorf("the jump host password of volume %s requires 'backend=%s'", v.Name, BackendNative)
+	}
+	strict := jump.StrictHostKeyChecking
+	if strict == "" {
+		strict = StrictHostKeyCheckingNo
+	}
+
+	args := []string{"-o", fmt.Sprintf("ProxyCommand='%s' %s %%h %%p", self, ProxyJumpCommand)}
+	env := []string{
+		jumpEnvAddress + "=" + jump.sshAddress(),
+		jumpEnvUser + "=" + jump.sshUser(),
+		jumpEnvIdentity + "=" + jump.IdentityFile,
+		jumpEnvKnownHosts + "=" + jump.KnownHostsFile,
+		jumpEnvStrict + "=" + strict,
+		jumpEnvTimeout + "=" + timeout.String(),
+	}
+	return args, env, nil
+}
+
+// runProxyJump connects stdin and stdout to host:port through the jump
+// host that is described by the environment. It is run by ssh as the
+// ProxyCommand of volumes with a jump host.
+func runProxyJump(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <host> <port>", ProxyJumpCommand)
+	}
+	address := os.Getenv(jumpEnvAddress)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid jump host address '%s' (%s)", address, err)
+	}
+	timeout, err := parseMountTimeout(os.Getenv(jumpEnvTimeout))
+	if err != nil {
+		timeout = DefaultMountTimeout
+	}
+
+	jump := &sshfsVolume{
+		Name:                  "jump",
+		SSHCmd:                sshTarget{User: os.Getenv(jumpEnvUser), Host: host}.String(),
+		Port:                  port,
+		IdentityFile:          os.Getenv(jumpEnvIdentity),
+		KnownHostsFile:        os.Getenv(jumpEnvKnownHosts),
+		StrictHostKeyChecking: os.Getenv(jumpEnvStrict),
+	}
+	client, err := jump.dialSSH(timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the jump host, %s", err)
+	}
+	defer client.Close()
+
+	target := net.JoinHostPort(strings.Trim(args[0], "[]"), args[1])
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("the jump host %s failed to connect to %s (%s)", address, target, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, os.Stdin)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(os.Stdout, conn)
+		done <- struct{}{}
+	}()
+	<-done
+	log.Debugf("Closed the connection to %s through the jump host %s", target, address)
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testJumpServer accepts password authenticated ssh connections on localhost
+// and forwards every direct-tcpip channel to the target address
+func testJumpServer(t *testing.T, password string, hostKey ssh.Signer, target string) string {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) != password {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					if newChannel.ChannelType() != "direct-tcpip" {
+						newChannel.Reject(ssh.UnknownChannelType, "only forwarding in tests")
+						continue
+					}
+					forwarded, err := net.Dial("tcp", target)
+					if err != nil {
+						newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						forwarded.Close()
+						continue
+					}
+					go ssh.DiscardRequests(requests)
+					go func() {
+						io.Copy(forwarded, channel)
+						forwarded.Close()
+					}()
+					go func() {
+						io.Copy(channel, forwarded)
+						channel.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestJumpOptions(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{
+		"sshcmd":                   "user@host:/data",
+		"password":                 "pw",
+		"jump_host":                "bastion.example.com",
+		"jump_port":                "2222",
+		"jump_password":            "jumppw",
+		"backend":                  BackendNative,
+		"strict_host_key_checking": StrictHostKeyCheckingAcceptNew,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.jumpStatus() != "user@bastion.example.com:2222" {
+		t.Fatalf("Expected the jump host to default to the volume's user, got %s", vol.jumpStatus())
+	}
+	if vol.JumpKnownHostsFile != vol.MountPoint+"_jump_known_hosts" {
+		t.Fatalf("Expected a known_hosts file of the jump host, got %q", vol.JumpKnownHostsFile)
+	}
+	if _, err := os.Stat(vol.JumpKnownHostsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, options := range []map[string]string{
+		{"jump_user": "admin"},
+		{"jump_host": "bastion"},
+		{"jump_host": "bastion", "jump_identity": "/root/.ssh/id_ed25519", "jump_password": "jumppw", "backend": BackendNative},
+		{"jump_host": "bastion", "jump_port": "port", "jump_identity": "/root/.ssh/id_ed25519"},
+		{"jump_host": "-oProxyCommand=sh", "jump_identity": "/root/.ssh/id_ed25519"},
+		// The ProxyCommand of the exec backend can't be given the password
+		{"jump_host": "bastion", "jump_password": "jumppw"},
+	} {
+		options["sshcmd"] = "user@host:/data"
+		options["password"] = "pw"
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		if err := vol.setupOptions(options); err == nil {
+			t.Errorf("Expected the jump options %v to be rejected", redactOptions(options))
+		}
+	}
+}
+
+func TestProxyJumpArgs(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{
+		"sshcmd":                   "user@host:/data",
+		"password":                 "pw",
+		"strict_host_key_checking": "no",
+		"jump_host":                "bastion",
+		"jump_user":                "admin",
+		"jump_identity":            "/root/.ssh/id_ed25519",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, env, err := vol.proxyJumpArgs(DefaultMountTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || !strings.HasSuffix(args[1], " "+ProxyJumpCommand+" %h %p") {
+		t.Fatalf("Expected the plugin binary as ProxyCommand, got %v", args)
+	}
+	for _, expected := range []string{
+		jumpEnvAddress + "=bastion:22",
+		jumpEnvUser + "=admin",
+		jumpEnvIdentity + "=/root/.ssh/id_ed25519",
+		jumpEnvStrict + "=" + StrictHostKeyCheckingNo,
+	} {
+		if !containsFold(env, expected) {
+			t.Errorf("Expected %s in the environment %v", expected, env)
+		}
+	}
+
+	for _, variable := range env {
+		if strings.Contains(variable, "pw") {
+			t.Fatalf("Expected no password in the environment, got %s", variable)
+		}
+	}
+	vol.jumpPassword = "jumppw"
+	vol.JumpIdentityFile = ""
+	if _, _, err := vol.proxyJumpArgs(DefaultMountTimeout); err == nil {
+		t.Fatal("Expected the exec backend to refuse a jump host password")
+	}
+
+	if err := runProxyJump([]string{"host"}); err == nil {
+		t.Fatal("Expected the proxy-jump command to require a host and port")
+	}
+}
+
+func TestJumpPasswordSealed(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":                   "user@host:/data",
+		"password":                 "pw",
+		"jump_host":                "bastion",
+		"jump_password":            "jumppw",
+		"backend":                  BackendNative,
+		"strict_host_key_checking": StrictHostKeyCheckingAcceptNew,
+	})
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["jump_host"] != "user@bastion:22" {
+		t.Fatalf("Expected the jump host in the status, got %v", res.Volume.Status)
+	}
+
+	state, err := os.ReadFile(d.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(state), "jumppw") {
+		t.Fatal("Expected the jump host password to be sealed in the state")
+	}
+	d = newTestDriver(t, basePath, newFakeMounter())
+	if d.volumes["vol"].jumpPassword != "jumppw" {
+		t.Fatal("Expected the jump host password to be restored")
+	}
+
+	if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.volumePath, "vol_jump_known_hosts")); !os.IsNotExist(err) {
+		t.Fatal("Expected the jump host's known_hosts file to be removed")
+	}
+}
+
+func TestPinnedHostKeyThroughJumpHost(t *testing.T) {
+	jumpKey, serverKey := testHostKeys(t)
+	target := testSSHServerWithKeys(t, "secret", []ssh.Signer{serverKey})
+	jumpAddress := testJumpServer(t, "jumppw", jumpKey, target)
+	jumpHost, jumpPort, _ := net.SplitHostPort(jumpAddress)
+
+	// The server's name only resolves on the jump host
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{
+		"sshcmd":               "user@internal.invalid:/data",
+		"password":             "secret",
+		"backend":              BackendNative,
+		"host_key_fingerprint": ssh.FingerprintSHA256(serverKey.PublicKey()),
+		"jump_host":            jumpHost,
+		"jump_port":            jumpPort,
+		"jump_password":        "jumppw",
+		"jump_known_hosts":     knownhosts.Line([]string{knownhosts.Normalize(jumpAddress)}, jumpKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.pinHostKey(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Expected the host key to be fetched through the jump host, got %s", err)
+	}
+	client, err := vol.dialSSH(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
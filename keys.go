@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// supportedKeyTypes are the public key algorithms of the accepted private keys
+var supportedKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:      true,
+	ssh.KeyAlgoECDSA256: true,
+	ssh.KeyAlgoECDSA384: true,
+	ssh.KeyAlgoECDSA521: true,
+	ssh.KeyAlgoED25519:  true,
+}
+
+// decodeKey returns the private key in OpenSSH or PEM form. Keys that are
+// base64 encoded, such that they survive the quoting of the command line,
+// are decoded first.
+func decodeKey(val string) (string, error) {
+	key := strings.TrimSpace(val)
+	if !strings.HasPrefix(key, "-----BEGIN ") {
+		compact := strings.Join(strings.Fields(key), "")
+		decoded, err := base64.StdEncoding.DecodeString(compact)
+		if err != nil {
+			return "", fmt.Errorf("the private key is neither in OpenSSH or PEM form, nor base64 encoded")
+		}
+		key = strings.TrimSpace(string(decoded))
+	}
+	// Private keys should end in '\n' such that
+	// the key file is a valid IdentityFile
+	return key + "\n", nil
+}
+
+// parseKey parses the private key, decrypting it with the passphrase if
+// it is set, and checks that it is of a supported type
+func parseKey(key string, passphrase string) (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(key))
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("the private key is encrypted, set the 'key_passphrase' option")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the private key (%s)", err)
+	}
+	if keyType := signer.PublicKey().Type(); !supportedKeyTypes[keyType] {
+		return nil, fmt.Errorf("the private key type %s is not supported, use an RSA, ECDSA or Ed25519 key", keyType)
+	}
+	return signer, nil
+}
+
+// decryptKey returns the private key without its passphrase, in OpenSSH form,
+// such that ssh can read it non-interactively
+func decryptKey(key string, passphrase string) (string, error) {
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the private key (%s)", err)
+	}
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the private key (%s)", err)
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// validateKey checks the volume's private key, if it is available when the
+// volume is created, and records its type and fingerprint
+func (v *sshfsVolume) validateKey() error {
+	key := v.identityKey
+	path := v.IdentityKeyFile
+	if path == "" && v.IdentityFile != v.keyFile() {
+		path = v.IdentityFile
+	}
+	if key == "" && path != "" {
+		// Key files might be provisioned after the volume is created
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the private key %s (%s)", path, err)
+		}
+		key = string(data)
+	}
+	if key == "" {
+		return nil
+	}
+
+	signer, err := parseKey(key, v.keyPassphrase)
+	if err != nil {
+		return err
+	}
+	v.KeyType = signer.PublicKey().Type()
+	v.KeyFingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	return nil
+}
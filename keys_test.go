@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/crypto/ssh"
+)
+
+// testPrivateKey returns a new Ed25519 private key in OpenSSH form,
+// encrypted with the passphrase if it is set
+func testPrivateKey(t *testing.T, passphrase string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return marshalTestKey(t, key, passphrase)
+}
+
+func marshalTestKey(t *testing.T, key interface{}, passphrase string) string {
+	var block *pem.Block
+	var err error
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestDecodeKey(t *testing.T) {
+	key := testPrivateKey(t, "")
+	for _, val := range []string{key, strings.TrimSpace(key), base64.StdEncoding.EncodeToString([]byte(key))} {
+		decoded, err := decodeKey(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != key {
+			t.Fatalf("Expected the decoded key to be %q, got %q", key, decoded)
+		}
+	}
+	if _, err := decodeKey("not a key!"); err == nil {
+		t.Fatal("Expected an invalid key to be rejected")
+	}
+}
+
+func TestParseKeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for keyType, key := range map[string]string{
+		ssh.KeyAlgoRSA:      string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})),
+		ssh.KeyAlgoECDSA256: marshalTestKey(t, ecdsaKey, ""),
+		ssh.KeyAlgoED25519:  testPrivateKey(t, ""),
+	} {
+		signer, err := parseKey(key, "")
+		if err != nil {
+			t.Fatalf("Failed to parse the %s key: %s", keyType, err)
+		}
+		if signer.PublicKey().Type() != keyType {
+			t.Fatalf("Expected a %s key, got %s", keyType, signer.PublicKey().Type())
+		}
+	}
+}
+
+func TestKeyPassphrase(t *testing.T) {
+	key := testPrivateKey(t, "hunter2")
+	if _, err := parseKey(key, ""); err == nil || !strings.Contains(err.Error(), "key_passphrase") {
+		t.Fatalf("Expected a missing passphrase to be reported, got %v", err)
+	}
+	if _, err := parseKey(key, "wrong"); err == nil {
+		t.Fatal("Expected a wrong passphrase to be rejected")
+	}
+
+	decrypted, err := decryptKey(key, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseKey(decrypted, ""); err != nil {
+		t.Fatalf("Expected the decrypted key to parse without a passphrase: %s", err)
+	}
+
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	if err := vol.setupOptions(map[string]string{"sshcmd": "u@h:/p", "ssh_key": key, "key_passphrase": "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	_, loaded, err := vol.loadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseKey(loaded, ""); err != nil {
+		t.Fatalf("Expected the mounted key to be decrypted: %s", err)
+	}
+}
+
+func TestCreateValidatesKey(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+
+	for _, options := range []map[string]string{
+		{"sshcmd": "user@host:/data", "ssh_key": base64.StdEncoding.EncodeToString([]byte("garbage"))},
+		{"sshcmd": "user@host:/data", "ssh_key": testPrivateKey(t, "secret")},
+		{"sshcmd": "user@host:/data", "password": "pw", "key_passphrase": "secret"},
+	} {
+		if err := d.Create(&volume.CreateRequest{Name: "bad", Options: options}); err == nil {
+			t.Errorf("Expected the options %v to be rejected", redactOptions(options))
+		}
+	}
+
+	key := testPrivateKey(t, "secret")
+	createTestVolume(t, d, "vol", map[string]string{
+		"sshcmd":         "user@host:/data",
+		"ssh_key":        base64.StdEncoding.EncodeToString([]byte(key)),
+		"key_passphrase": "secret",
+	})
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["key_type"] != ssh.KeyAlgoED25519 ||
+		!strings.HasPrefix(res.Volume.Status["key_fingerprint"].(string), "SHA256:") {
+		t.Fatalf("Expected the key's type and fingerprint in the status, got %v", res.Volume.Status)
+	}
+
+	// The passphrase is sealed with the volume
+	d = newTestDriver(t, basePath, newFakeMounter())
+	if d.volumes["vol"].keyPassphrase != "secret" {
+		t.Fatal("Expected the passphrase to be restored")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RedactedValue replaces secrets in log output
+const RedactedValue = "[REDACTED]"
+
+// configureLogging sets the log level from DEBUG and the log format from
+// LOG_FORMAT, which is either text or json
+func configureLogging() error {
+	if ok, _ := strconv.ParseBool(os.Getenv("DEBUG")); ok {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("LOG_FORMAT must be either text or json, not '%s'", format)
+	}
+	log.AddHook(redactHook{})
+	return nil
+}
+
+// isSecretOption reports whether the create option carries a secret.
+// Options that name a file with a secret are not secret themselves.
+func isSecretOption(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_file") {
+		return false
+	}
+	for _, secret := range []string{"password", "passphrase", "secret", "id_rsa", "ssh_key", "private_key"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactOptions returns a copy of the options with the secrets replaced
+func redactOptions(options map[string]string) map[string]string {
+	redacted := make(map[string]string, len(options))
+	for key, val := range options {
+		if isSecretOption(key) && val != "" {
+			val = RedactedValue
+		}
+		redacted[key] = val
+	}
+	return redacted
+}
+
+// redactHook redacts secret fields and options of every log entry
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	for key, val := range entry.Data {
+		switch val := val.(type) {
+		case map[string]string:
+			entry.Data[key] = redactOptions(val)
+		case string:
+			if isSecretOption(key) && val != "" {
+				entry.Data[key] = RedactedValue
+			}
+		}
+	}
+	return nil
+}
+
+// String describes the volume without its secrets,
+// such that logging a volume never reveals them
+func (v *sshfsVolume) String() string {
+	return fmt.Sprintf("{Name:%s SSHCmd:%s Port:%s Backend:%s Auth:%s Options:%v}",
+		v.Name, v.SSHCmd, v.Port, v.backend(), v.authMethod(), v.Options)
+}
+
+// newRequestID returns a random ID that correlates the log entries of a request
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestLogger returns the logger of a plugin request on the named volume
+func requestLogger(op string, name string) *log.Entry {
+	fields := log.Fields{"request_id": newRequestID(), "op": op}
+	if name != "" {
+		fields["volume"] = name
+	}
+	return log.WithFields(fields)
+}
+
+// volumeLogger adds the volume's server to the request's logger
+func volumeLogger(logger *log.Entry, vol *sshfsVolume) *log.Entry {
+	_, host, _ := splitSSHCmd(vol.SSHCmd)
+	return logger.WithField("host", host)
+}
+
+// logRequest logs the outcome and duration of a request once it returns
+func logRequest(logger *log.Entry, start time.Time, err *error) {
+	logger = logger.WithField("duration", time.Since(start).String())
+	if *err != nil {
+		logger.WithField("error", (*err).Error()).Debug("Request failed")
+		return
+	}
+	logger.Debug("Request completed")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRedactOptions(t *testing.T) {
+	options := map[string]string{
+		"sshcmd":        "user@host:/data",
+		"password":      "secret",
+		"id_rsa":        "KEY",
+		"password_file": "volume.pw",
+		"cache":         "yes",
+	}
+	redacted := redactOptions(options)
+	for key, val := range map[string]string{
+		"sshcmd":        "user@host:/data",
+		"password":      RedactedValue,
+		"id_rsa":        RedactedValue,
+		"password_file": "volume.pw",
+		"cache":         "yes",
+	} {
+		if redacted[key] != val {
+			t.Errorf("Expected %s to be %q, got %q", key, val, redacted[key])
+		}
+	}
+	if options["password"] != "secret" {
+		t.Fatal("Expected the options themselves to be kept")
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(redactHook{})
+
+	logger.WithFields(log.Fields{
+		"options":  map[string]string{"sshcmd": "user@host:/data", "password": "secret"},
+		"password": "secret",
+		"volume":   "vol",
+	}).Info("Create request")
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("Expected the secrets to be redacted, got %s", buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON log entry, got %s", buf.String())
+	}
+	if entry["volume"] != "vol" || entry["password"] != RedactedValue {
+		t.Fatalf("Unexpected log entry %v", entry)
+	}
+}
+
+func TestVolumeString(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", SSHCmd: "user@host:/data", Password: "secret", identityKey: "KEY"}
+	for _, s := range []string{vol.String(), fmt.Sprintf("%v", vol), fmt.Sprintf("%s", vol)} {
+		if strings.Contains(s, "secret") || strings.Contains(s, "KEY") || !strings.Contains(s, "vol") {
+			t.Fatalf("Expected the volume to be described without its secrets, got %s", s)
+		}
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer log.SetFormatter(&log.TextFormatter{})
+	defer log.SetLevel(log.InfoLevel)
+
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("DEBUG", "1")
+	if err := configureLogging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok || log.GetLevel() != log.DebugLevel {
+		t.Fatal("Expected JSON debug logging")
+	}
+
+	t.Setenv("LOG_FORMAT", "xml")
+	if err := configureLogging(); err == nil {
+		t.Fatal("Expected an unknown log format to be rejected")
+	}
+}
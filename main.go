@@ -2,7 +2,7 @@ package main
 
 import (
 	"os"
-	"strconv"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -16,19 +16,72 @@ const (
 )
 
 func main() {
-	debug := os.Getenv("DEBUG")
-	if ok, _ := strconv.ParseBool(debug); ok {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	if len(os.Args) > 1 && os.Args[1] == ProxyJumpCommand {
+		if err := runProxyJump(os.Args[2:]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	driver, err := newSshfsDriver(DefaultBasePath)
+	if err := configureLogging(); err != nil {
+		log.Errorf("Failed to configure logging %s", err)
+		os.Exit(1)
+	}
+
+	secrets, err := newSecretStore()
+	if err != nil {
+		log.Errorf("Failed to create the secret store %s", err)
+		os.Exit(1)
+	}
+
+	unmount, err := unmountPolicyFromEnv()
+	if err != nil {
+		log.Errorf("Failed to configure unmounting %s", err)
+		os.Exit(1)
+	}
+
+	mountTimeout, err := mountTimeoutFromEnv()
+	if err != nil {
+		log.Errorf("Failed to configure mounting %s", err)
+		os.Exit(1)
+	}
+
+	multiplex, err := multiplexFromEnv()
+	if err != nil {
+		log.Errorf("Failed to configure multiplexing %s", err)
+		os.Exit(1)
+	}
+
+	policyPath := os.Getenv("OPTIONS_POLICY_FILE")
+	if policyPath == "" {
+		policyPath = filepath.Join(DefaultBasePath, "state", "sshfs-policy.json")
+	}
+	policy, err := loadOptionPolicy(policyPath)
+	if err != nil {
+		log.Errorf("Failed to load the option policy %s", err)
+		os.Exit(1)
+	}
+
+	config := driverConfig{Policy: policy, KeyHook: os.Getenv("EPHEMERAL_KEY_HOOK"), MountTimeout: mountTimeout}
+	driver, err := newSshfsDriver(DefaultBasePath, secrets, newBackendMounter(unmount, mountTimeout, multiplex), config)
 	if err != nil {
 		log.Errorf("Failed to create the driver %s", err)
 		os.Exit(1)
 	}
 
-	handler := volume.NewHandler(driver)
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go serveMetrics(addr, driver)
+	}
+
+	// The volumes are reconciled while the socket is served, since docker
+	// gives up on enabling a plugin that doesn't serve it soon enough
+	go func() {
+		if err := driver.reconcile(MountInfoPath); err != nil {
+			log.Errorf("Failed to reconcile the volume state with the active mounts (%s)", err)
+		}
+	}()
+
+	handler := volume.NewHandler(metricsDriver{driver: driver})
 	handler.ServeUnix(DefaultUnixSocket, 0)
 }
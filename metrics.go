@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "sshfs"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Volume plugin requests by method and result.",
+	}, []string{"method", "result"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of volume plugin requests by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method"})
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Duration of establishing the connection of a volume by backend.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"backend"})
+	mountFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "Failed mounts and reconnects by reason.",
+	}, []string{"reason"})
+	reconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconnects_total",
+		Help:      "Reconnects of unhealthy volumes by result.",
+	}, []string{"result"})
+)
+
+var (
+	volumesDesc = prometheus.NewDesc(metricsNamespace+"_volumes",
+		"Number of volumes known to the plugin.", nil, nil)
+	activeMountsDesc = prometheus.NewDesc(metricsNamespace+"_active_mounts",
+		"Number of volumes that are mounted.", nil, nil)
+	refCountDesc = prometheus.NewDesc(metricsNamespace+"_volume_ref_count",
+		"Number of containers that are using the volume.", []string{"volume"}, nil)
+	volumeReconnectsDesc = prometheus.NewDesc(metricsNamespace+"_volume_reconnects",
+		"Number of times the volume's connection has been reestablished.", []string{"volume"}, nil)
+)
+
+// observeMount records the duration of a mount and the reason it failed
+func observeMount(backend string, start time.Time, err error) {
+	if err != nil {
+		mountFailures.WithLabelValues(mountFailureReason(err)).Inc()
+		return
+	}
+	mountDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+}
+
+// mountFailureReason classifies a mount error by the messages of the
+// driver, ssh and sshfs, such that the metric has a bounded set of labels
+func mountFailureReason(err error) string {
+	msg := strings.ToLower(err.Error())
+	for _, reason := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"timeout", []string{"timed out", "timeout"}},
+		{"host_key", []string{"host key", "host_key"}},
+		{"remote_path", []string{"remote path"}},
+		{"capacity", []string{"min_free"}},
+		{"auth", []string{"permission denied", "unable to authenticate", "authentication", "credential"}},
+		{"policy", []string{"option policy"}},
+		{"profile", []string{"profile"}},
+		{"connection", []string{"connection refused", "no route to host", "could not resolve", "failed to connect", "connection reset", "network is unreachable"}},
+	} {
+		for _, pattern := range reason.patterns {
+			if strings.Contains(msg, pattern) {
+				return reason.name
+			}
+		}
+	}
+	return "other"
+}
+
+// volumeCollector reports the volumes' state at the time of the scrape
+type volumeCollector struct {
+	driver *sshfsDriver
+}
+
+func (c volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesDesc
+	ch <- activeMountsDesc
+	ch <- refCountDesc
+	ch <- volumeReconnectsDesc
+}
+
+func (c volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	d := c.driver
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	active := 0
+	for _, vol := range d.volumes {
+		if vol.ConnectedAt != "" {
+			active++
+		}
+		ch <- prometheus.MustNewConstMetric(refCountDesc, prometheus.GaugeValue, float64(vol.RefCount), vol.Name)
+		ch <- prometheus.MustNewConstMetric(volumeReconnectsDesc, prometheus.CounterValue, float64(vol.ReconnectCount), vol.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(len(d.volumes)))
+	ch <- prometheus.MustNewConstMetric(activeMountsDesc, prometheus.GaugeValue, float64(active))
+}
+
+// newMetricsRegistry returns a registry with the plugin's metrics
+func newMetricsRegistry(d *sshfsDriver) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		requestsTotal,
+		requestDuration,
+		mountDuration,
+		mountFailures,
+		reconnectsTotal,
+		volumeCollector{driver: d},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// serveMetrics serves the plugin's metrics at /metrics on addr
+func serveMetrics(addr string, d *sshfsDriver) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(newMetricsRegistry(d), promhttp.HandlerOpts{}))
+	log.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Failed to serve metrics on %s (%s)", addr, err)
+	}
+}
+
+// metricsDriver counts and times the requests to the driver
+type metricsDriver struct {
+	driver volume.Driver
+}
+
+func observeRequest(method string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	requestsTotal.WithLabelValues(method, result).Inc()
+	requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (m metricsDriver) Create(r *volume.CreateRequest) error {
+	start := time.Now()
+	err := m.driver.Create(r)
+	observeRequest("create", start, err)
+	return err
+}
+
+func (m metricsDriver) List() (*volume.ListResponse, error) {
+	start := time.Now()
+	res, err := m.driver.List()
+	observeRequest("list", start, err)
+	return res, err
+}
+
+func (m metricsDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	start := time.Now()
+	res, err := m.driver.Get(r)
+	observeRequest("get", start, err)
+	return res, err
+}
+
+func (m metricsDriver) Remove(r *volume.RemoveRequest) error {
+	start := time.Now()
+	err := m.driver.Remove(r)
+	observeRequest("remove", start, err)
+	return err
+}
+
+func (m metricsDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+	start := time.Now()
+	res, err := m.driver.Path(r)
+	observeRequest("path", start, err)
+	return res, err
+}
+
+func (m metricsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	start := time.Now()
+	res, err := m.driver.Mount(r)
+	observeRequest("mount", start, err)
+	return res, err
+}
+
+func (m metricsDriver) Unmount(r *volume.UnmountRequest) error {
+	start := time.Now()
+	err := m.driver.Unmount(r)
+	observeRequest("unmount", start, err)
+	return err
+}
+
+func (m metricsDriver) Capabilities() *volume.CapabilitiesResponse {
+	start := time.Now()
+	res := m.driver.Capabilities()
+	observeRequest("capabilities", start, nil)
+	return res
+}
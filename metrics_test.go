@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestMountFailureReason(t *testing.T) {
+	tests := map[string]string{
+		"Mounting volume vol timed out after 30s":                          "timeout",
+		"read: Connection reset by peer, Host key verification failed":     "host_key",
+		"user@host: Permission denied (publickey,password).":               "auth",
+		"the option 'ssh_command' is denied by the plugin's option policy": "policy",
+		"ssh: connect to host h port 22: Connection refused":               "connection",
+		"fusermount: mountpoint is not empty":                              "other",
+	}
+	for msg, reason := range tests {
+		if got := mountFailureReason(fmt.Errorf(msg)); got != reason {
+			t.Errorf("mountFailureReason(%q) = %s, want %s", msg, got, reason)
+		}
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	driver := metricsDriver{driver: d}
+
+	for _, name := range []string{"vol1", "vol2"} {
+		if err := driver.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"sshcmd": "user@host:/data", "password": "secret"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := driver.Mount(&volume.MountRequest{Name: "vol1", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	families, err := newMetricsRegistry(d).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				key += fmt.Sprintf(",%s=%s", label.GetName(), label.GetValue())
+			}
+			switch {
+			case metric.GetGauge() != nil:
+				values[key] = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				values[key] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+
+	expected := map[string]float64{
+		"sshfs_volumes":                      2,
+		"sshfs_active_mounts":                1,
+		"sshfs_volume_ref_count,volume=vol1": 2,
+		"sshfs_volume_ref_count,volume=vol2": 0,
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, values[key])
+		}
+	}
+	if values["sshfs_requests_total,method=mount,result=success"] < 2 {
+		t.Errorf("Expected the mount requests to be counted, got %v", values)
+	}
+}
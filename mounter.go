@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mounter mounts the remote path of a volume at its mountpoint
+type Mounter interface {
+	// Mount connects to the volume's server and mounts its remote path
+	Mount(vol *sshfsVolume) error
+	// Unmount unmounts the volume and closes the connection
+	Unmount(vol *sshfsVolume) error
+	// Detach lazily unmounts a volume whose connection is dead,
+	// even if the mountpoint is still in use
+	Detach(vol *sshfsVolume) error
+	// Check returns an error if the volume's mount is no longer served
+	Check(vol *sshfsVolume) error
+}
+
+// mountStatuser is implemented by mounters that report metrics of a mount
+type mountStatuser interface {
+	Status(vol *sshfsVolume) map[string]interface{}
+}
+
+// backendMounter dispatches to the mounter of the volume's backend
+type backendMounter struct {
+	exec   Mounter
+	native *nativeMounter
+}
+
+func newBackendMounter(policy unmountPolicy, mountTimeout time.Duration, multiplex bool) *backendMounter {
+	return &backendMounter{
+		exec: &execMounter{
+			policy:    policy,
+			timeout:   mountTimeout,
+			multiplex: multiplex,
+			masters:   newControlMasters(DefaultControlDir),
+		},
+		native: newNativeMounter(policy, mountTimeout, multiplex),
+	}
+}
+
+func (m *backendMounter) backend(vol *sshfsVolume) Mounter {
+	if vol.Backend == BackendNative {
+		return m.native
+	}
+	return m.exec
+}
+
+func (m *backendMounter) Mount(vol *sshfsVolume) error {
+	return m.backend(vol).Mount(vol)
+}
+
+func (m *backendMounter) Unmount(vol *sshfsVolume) error {
+	return m.backend(vol).Unmount(vol)
+}
+
+func (m *backendMounter) Detach(vol *sshfsVolume) error {
+	return m.backend(vol).Detach(vol)
+}
+
+func (m *backendMounter) Check(vol *sshfsVolume) error {
+	return m.backend(vol).Check(vol)
+}
+
+func (m *backendMounter) Status(vol *sshfsVolume) map[string]interface{} {
+	if statuser, ok := m.backend(vol).(mountStatuser); ok {
+		return statuser.Status(vol)
+	}
+	return nil
+}
+
+// execMounter mounts volumes by executing the sshfs binary
+type execMounter struct {
+	policy unmountPolicy
+	// The mount timeout of volumes that don't set their own
+	timeout time.Duration
+	// Whether volumes that don't set the multiplex option share
+	// the ssh connection to their server through a ControlMaster
+	multiplex bool
+	masters   *controlMasters
+}
+
+func (m *execMounter) Mount(vol *sshfsVolume) error {
+	strict := vol.StrictHostKeyChecking
+	if strict == "" {
+		// Volumes created before host key checking was configurable
+		strict = StrictHostKeyCheckingNo
+	}
+
+	deadline := vol.deadline(m.timeout)
+	if vol.HostKeyFingerprint != "" {
+		if err := vol.pinHostKey(deadline); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sshfs", "-oStrictHostKeyChecking="+strict, vol.SSHCmd, vol.MountPoint)
+	// sshfs runs ssh as a child, so the whole process group is killed on
+	// timeout. A mounted sshfs daemonizes into its own session.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = ProcessExitGrace
+
+	if vol.KnownHostsFile != "" {
+		cmd.Args = append(cmd.Args, "-o", "UserKnownHostsFile="+vol.KnownHostsFile)
+	}
+
+	if vol.Port != "" {
+		cmd.Args = append(cmd.Args, "-p", vol.Port)
+	}
+
+	password, key, err := vol.loadCredentials()
+	if err != nil {
+		return err
+	}
+
+	if vol.CreateRemotePath {
+		if err := vol.createRemotePath(deadline); err != nil {
+			return err
+		}
+	}
+	// ssh and the jump host get the time that is left for the mount
+	timeout := time.Until(deadline)
+
+	if password != "" {
+		cmd.Args = append(cmd.Args, "-o", "workaround=rename", "-o", "password_stdin")
+		cmd.Stdin = strings.NewReader(password)
+	}
+
+	identityFile := vol.IdentityFile
+	// ssh has read the key once sshfs has connected and returns,
+	// so the key is only on disk for the duration of the mount command
+	if key != "" {
+		identityFile = vol.keyFile()
+		if err := vol.saveKey(key); err != nil {
+			return err
+		}
+		defer func() {
+			if err := shredFile(identityFile); err != nil {
+				log.Errorf("Failed to remove the volume %s's identity file: %s (%s)", vol.Name, identityFile, err)
+			}
+		}()
+	}
+
+	if identityFile != "" {
+		cmd.Args = append(cmd.Args, "-o", "IdentityFile="+identityFile)
+	}
+
+	// Append the rest
+	for _, option := range vol.Options {
+		cmd.Args = append(cmd.Args, "-o", option)
+	}
+	for _, option := range defaultSSHOptions(vol.Options, timeout) {
+		cmd.Args = append(cmd.Args, "-o", option)
+	}
+
+	if vol.JumpHost != "" {
+		args, env, err := vol.proxyJumpArgs(timeout)
+		if err != nil {
+			return err
+		}
+		cmd.Args = append(cmd.Args, args...)
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	mounted := false
+	if m.masters != nil && vol.multiplexed(m.multiplex) {
+		args, err := m.masters.acquire(vol, vol.connectionKey(password, key))
+		if err != nil {
+			return err
+		}
+		cmd.Args = append(cmd.Args, args...)
+		defer func() {
+			if !mounted {
+				m.masters.release(vol)
+			}
+		}()
+	}
+
+	log.Debugf("Executing mount command %v", cmd)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		// The mount might have completed as the command was killed
+		if derr := detachMount(vol.MountPoint); derr == nil {
+			log.Warningf("Detached the timed out mount of volume %s", vol.Name)
+		}
+		msg := fmt.Sprintf("Mounting volume %s timed out after %s, the server %s did not respond", vol.Name, vol.mountTimeout(m.timeout), vol.sshAddress())
+		log.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	if err != nil {
+		return fmt.Errorf("sshfs command failed %v %v (%s)", cmd, err, output)
+	}
+	mounted = true
+	return nil
+}
+
+func (m *execMounter) Unmount(vol *sshfsVolume) error {
+	// The process is found before the unmount, which might detach it
+	pid, perr := findSshfsProcess(vol.MountPoint)
+	if err := m.policy.unmount(vol.MountPoint); err != nil {
+		return err
+	}
+	if perr == nil {
+		if err := terminateProcess(pid, m.policy.Timeout); err != nil {
+			log.Errorf("Failed to terminate the sshfs process %d of volume %s (%s)", pid, vol.Name, err)
+		}
+	}
+	m.releaseMaster(vol)
+
+	// Check that the mountpoint is empty
+	files, err := ioutil.ReadDir(vol.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return fmt.Errorf("after unmount %d files still exists in %s", len(files), vol.MountPoint)
+	}
+
+	return nil
+}
+
+func (m *execMounter) Detach(vol *sshfsVolume) error {
+	pid, perr := findSshfsProcess(vol.MountPoint)
+	if err := detachMount(vol.MountPoint); err != nil {
+		return err
+	}
+	m.releaseMaster(vol)
+	if perr == nil {
+		return terminateProcess(pid, m.policy.Timeout)
+	}
+	return nil
+}
+
+// releaseMaster stops using the volume's shared connection, if it has one
+func (m *execMounter) releaseMaster(vol *sshfsVolume) {
+	if m.masters != nil {
+		m.masters.release(vol)
+	}
+}
+
+func (m *execMounter) Status(vol *sshfsVolume) map[string]interface{} {
+	if m.masters == nil {
+		return nil
+	}
+	return m.masters.status(vol)
+}
+
+func (m *execMounter) Check(vol *sshfsVolume) error {
+	if _, err := os.Stat(vol.MountPoint); err != nil {
+		return err
+	}
+	if _, err := findSshfsProcess(vol.MountPoint); err != nil {
+		return err
+	}
+	return nil
+}
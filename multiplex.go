@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultControlDir holds the sockets of the shared ssh connections.
+// Unix socket paths are short, so it is not below the base path.
+var DefaultControlDir = filepath.Join(os.TempDir(), "sshfs-control")
+
+// connectionSecret keys the connection keys, which name the control sockets,
+// such that the credentials they are derived from can't be guessed from them
+var connectionSecret = newConnectionSecret()
+
+func newConnectionSecret() []byte {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		log.Errorf("Failed to generate the connection secret %s", err)
+		os.Exit(1)
+	}
+	return secret
+}
+
+// multiplexFromEnv reads MULTIPLEX, which sets whether volumes share the
+// ssh connections to their server unless they set the multiplex option
+func multiplexFromEnv() (bool, error) {
+	raw := os.Getenv("MULTIPLEX")
+	if raw == "" {
+		return false, nil
+	}
+	multiplex, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid MULTIPLEX '%s', it must be true or false", raw)
+	}
+	return multiplex, nil
+}
+
+// multiplexed returns whether the volume shares its ssh connection,
+// or fallback if the volume doesn't set it
+func (v *sshfsVolume) multiplexed(fallback bool) bool {
+	if v.Multiplex == "" {
+		return fallback
+	}
+	multiplex, err := strconv.ParseBool(v.Multiplex)
+	if err != nil {
+		return fallback
+	}
+	return multiplex
+}
+
+// connectionKey identifies the ssh connections that volumes may share.
+// Volumes only share a connection if they connect to the same server with
+// the same credentials and host key checks, so the key is an HMAC of them
+// with the connectionSecret.
+func (v *sshfsVolume) connectionKey(password, key string) string {
+	identity := key
+	if identity == "" {
+		identity = v.IdentityFile
+	}
+	knownHosts := ""
+	if v.StrictHostKeyChecking == StrictHostKeyCheckingYes && v.KnownHostsFile != "" {
+		// Volumes that pin different host keys must not share a connection
+		content, err := ioutil.ReadFile(v.KnownHostsFile)
+		if err != nil {
+			content = []byte(v.KnownHostsFile)
+		}
+		knownHosts = string(content)
+	}
+
+	hash := hmac.New(sha256.New, connectionSecret)
+	for _, part := range []string{
+		v.backend(), v.sshUser(), v.sshAddress(), password, identity,
+		v.StrictHostKeyChecking, v.HostKeyFingerprint, knownHosts,
+		v.jumpStatus(), v.JumpIdentityFile, v.jumpPassword, v.JumpKnownHostsFile,
+	} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// connectionLabel describes a shared connection in the volume status
+func (v *sshfsVolume) connectionLabel() string {
+	return v.sshUser() + "@" + v.sshAddress()
+}
+
+// controlMasters tracks the volumes of the exec backend that share an ssh
+// ControlMaster. The first sshfs of a connection starts the master, which
+// persists until the last volume that uses it is unmounted.
+type controlMasters struct {
+	dir   string
+	mutex *sync.Mutex
+	// Names of the volumes that use each control socket
+	users map[string]map[string]bool
+	// Control socket of each volume and the label of its connection
+	sockets map[string]string
+	labels  map[string]string
+}
+
+func newControlMasters(dir string) *controlMasters {
+	return &controlMasters{
+		dir:     dir,
+		mutex:   &sync.Mutex{},
+		users:   make(map[string]map[string]bool),
+		sockets: make(map[string]string),
+		labels:  make(map[string]string),
+	}
+}
+
+// acquire registers the volume as a user of the connection and returns
+// the ssh options that attach its sshfs to the shared master.
+// It is called before mounting, such that the master is not torn down
+// by another volume while the mount uses it.
+func (c *controlMasters) acquire(vol *sshfsVolume, key string) ([]string, error) {
+	if err := os.MkdirAll(c.dir, VolumeDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create the control socket directory %s (%s)", c.dir, err)
+	}
+	socket := filepath.Join(c.dir, key)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if previous, ok := c.sockets[vol.Name]; ok && previous != socket {
+		c.releaseLocked(vol.Name)
+	}
+	if c.users[socket] == nil {
+		c.users[socket] = make(map[string]bool)
+	}
+	c.users[socket][vol.Name] = true
+	c.sockets[vol.Name] = socket
+	c.labels[socket] = vol.connectionLabel()
+
+	return []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + socket,
+		"-o", "ControlPersist=yes",
+	}, nil
+}
+
+// release unregisters the volume and stops the master
+// once no other volume uses it
+func (c *controlMasters) release(vol *sshfsVolume) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.releaseLocked(vol.Name)
+}
+
+func (c *controlMasters) releaseLocked(name string) {
+	socket, ok := c.sockets[name]
+	if !ok {
+		return
+	}
+	delete(c.sockets, name)
+	delete(c.users[socket], name)
+	if len(c.users[socket]) > 0 {
+		return
+	}
+	delete(c.users, socket)
+	delete(c.labels, socket)
+
+	if _, err := os.Stat(socket); err != nil {
+		// The master was never started or has exited by itself
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultConnectTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ssh", "-o", "ControlPath="+socket, "-O", "exit", "sshfs-control")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Errorf("Failed to stop the shared ssh connection %s (%s: %s)", socket, err, output)
+		return
+	}
+	log.Debugf("Stopped the shared ssh connection %s", socket)
+}
+
+// status describes the shared connection of the volume, if it has one
+func (c *controlMasters) status(vol *sshfsVolume) map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	socket, ok := c.sockets[vol.Name]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"shared_connection":         c.labels[socket],
+		"shared_connection_volumes": len(c.users[socket]),
+	}
+}
+
+// sshPool shares the ssh connections of native mounts. Each mount opens
+// its own sftp session on the shared connection, which is closed once
+// the last mount that uses it releases it.
+type sshPool struct {
+	mutex *sync.Mutex
+	conns map[string]*pooledClient
+}
+
+type pooledClient struct {
+	client *ssh.Client
+	label  string
+	users  int
+}
+
+func newSSHPool() *sshPool {
+	return &sshPool{mutex: &sync.Mutex{}, conns: make(map[string]*pooledClient)}
+}
+
+// acquire returns the shared connection of the volume,
+// and dials it if there is none
+func (p *sshPool) acquire(vol *sshfsVolume, timeout time.Duration) (*ssh.Client, string, error) {
+	password, identity, err := vol.loadCredentials()
+	if err != nil {
+		return nil, "", err
+	}
+	key := vol.connectionKey(password, identity)
+
+	p.mutex.Lock()
+	if conn, ok := p.conns[key]; ok {
+		conn.users++
+		p.mutex.Unlock()
+		return conn.client, key, nil
+	}
+	p.mutex.Unlock()
+
+	// Dial without holding the lock, such that connecting to one
+	// server doesn't block mounts of the others
+	client, err := vol.dialSSH(timeout)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if conn, ok := p.conns[key]; ok {
+		// Another mount connected in the meantime
+		client.Close()
+		conn.users++
+		return conn.client, key, nil
+	}
+	p.conns[key] = &pooledClient{client: client, label: vol.connectionLabel(), users: 1}
+	return client, key, nil
+}
+
+// release gives up a use of the shared connection
+// and closes it when it was the last
+func (p *sshPool) release(key string, client *ssh.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn, ok := p.conns[key]
+	if !ok || conn.client != client {
+		// The connection was discarded, and closed, after it failed
+		return
+	}
+	conn.users--
+	if conn.users > 0 {
+		return
+	}
+	delete(p.conns, key)
+	client.Close()
+}
+
+// discard closes a shared connection that failed, such that the mounts
+// that used it acquire a new connection when they reconnect
+func (p *sshPool) discard(key string, client *ssh.Client) {
+	p.mutex.Lock()
+	if conn, ok := p.conns[key]; ok && conn.client == client {
+		delete(p.conns, key)
+	}
+	p.mutex.Unlock()
+	client.Close()
+}
+
+// status describes the shared connection with the key
+func (p *sshPool) status(key string) map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn, ok := p.conns[key]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"shared_connection":         conn.label,
+		"shared_connection_volumes": conn.users,
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer accepts password authenticated ssh connections on localhost
+// and serves the sftp subsystem of the local filesystem on their sessions.
+// It returns the address it listens on.
+func testSSHServer(t *testing.T, password string, options ...sftp.ServerOption) string {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSSHServerWithKeys(t, password, []ssh.Signer{signer}, options...)
+}
+
+// testSSHServerWithKeys is a testSSHServer with the given host keys
+func testSSHServerWithKeys(t *testing.T, password string, hostKeys []ssh.Signer, options ...sftp.ServerOption) string {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) != password {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	for _, signer := range hostKeys {
+		config.AddHostKey(signer)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					if newChannel.ChannelType() != "session" {
+						newChannel.Reject(ssh.UnknownChannelType, "only sessions in tests")
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go serveTestSession(channel, requests, options)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTestSession(channel ssh.Channel, requests <-chan *ssh.Request, options []sftp.ServerOption) {
+	defer channel.Close()
+	for req := range requests {
+		// The subsystem request holds the length prefixed name
+		if req.Type != "subsystem" || string(req.Payload[4:]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		server, err := sftp.NewServer(channel, options...)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+		return
+	}
+}
+
+func TestConnectionKey(t *testing.T) {
+	newVol := func(options map[string]string) *sshfsVolume {
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		if err := vol.setupOptions(options); err != nil {
+			t.Fatal(err)
+		}
+		return vol
+	}
+	key := func(vol *sshfsVolume) string {
+		password, identity, err := vol.loadCredentials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vol.connectionKey(password, identity)
+	}
+
+	base := key(newVol(map[string]string{"sshcmd": "user@host:/data", "password": "pw"}))
+	if shared := key(newVol(map[string]string{"sshcmd": "user@host:/other", "password": "pw", "cache": "no"})); shared != base {
+		t.Fatal("Expected volumes with other paths on the same server to share the connection")
+	}
+	for _, options := range []map[string]string{
+		{"sshcmd": "other@host:/data", "password": "pw"},
+		{"sshcmd": "user@host:/data", "password": "other"},
+		{"sshcmd": "user@host:/data", "password": "pw", "port": "2222"},
+		{"sshcmd": "user@host:/data", "password": "pw", "backend": BackendNative},
+		{"sshcmd": "user@host:/data", "password": "pw", "strict_host_key_checking": StrictHostKeyCheckingAcceptNew},
+	} {
+		if key(newVol(options)) == base {
+			t.Errorf("Expected the options %v to use a connection of their own", redactOptions(options))
+		}
+	}
+
+	// The key depends on the secret of the process, not only on the credentials
+	secret := connectionSecret
+	connectionSecret = newConnectionSecret()
+	rekeyed := key(newVol(map[string]string{"sshcmd": "user@host:/data", "password": "pw"}))
+	connectionSecret = secret
+	if rekeyed == base {
+		t.Fatal("Expected the connection key to depend on the connection secret")
+	}
+
+	t.Setenv("MULTIPLEX", "")
+	if multiplex, err := multiplexFromEnv(); err != nil || multiplex {
+		t.Fatalf("Expected connections not to be shared by default, got %v (%v)", multiplex, err)
+	}
+
+	vol := newVol(map[string]string{"sshcmd": "user@host:/data", "password": "pw", "multiplex": "false"})
+	if vol.multiplexed(true) {
+		t.Fatal("Expected the volume's multiplex option to override the default")
+	}
+	if !newVol(map[string]string{"sshcmd": "user@host:/data", "password": "pw"}).multiplexed(true) {
+		t.Fatal("Expected the default to apply without the multiplex option")
+	}
+	if err := (&sshfsVolume{}).setupOptions(map[string]string{"sshcmd": "user@host:/data", "password": "pw", "multiplex": "often"}); err == nil {
+		t.Fatal("Expected an invalid multiplex option to be rejected")
+	}
+}
+
+func TestControlMasters(t *testing.T) {
+	// An ssh that records how the masters are stopped
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	masters := newControlMasters(filepath.Join(t.TempDir(), "control"))
+	first := &sshfsVolume{Name: "first", SSHCmd: "user@host:/a"}
+	second := &sshfsVolume{Name: "second", SSHCmd: "user@host:/b"}
+	args, err := masters.acquire(first, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(masters.dir, "key")
+	if !containsFold(args, "ControlPath="+socket) || !containsFold(args, "ControlMaster=auto") {
+		t.Fatalf("Expected the options of the shared master, got %v", args)
+	}
+	if _, err := masters.acquire(second, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if status := masters.status(second); status["shared_connection"] != "user@host:22" || status["shared_connection_volumes"] != 2 {
+		t.Fatalf("Expected both volumes to share the connection, got %v", status)
+	}
+
+	// The socket of a running master
+	if err := ioutil.WriteFile(socket, nil, VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	masters.release(first)
+	if _, err := os.Stat(calls); !os.IsNotExist(err) {
+		t.Fatal("Expected the master to keep running while a volume uses it")
+	}
+	masters.release(second)
+	output, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "-O exit") || !strings.Contains(string(output), socket) {
+		t.Fatalf("Expected the master to be stopped, got %q", output)
+	}
+	if masters.status(second) != nil {
+		t.Fatal("Expected no shared connection after the release")
+	}
+}
+
+func TestExecMountMultiplex(t *testing.T) {
+	bin := t.TempDir()
+	args := filepath.Join(bin, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "sshfs"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	m := &execMounter{
+		policy:    defaultUnmountPolicy,
+		timeout:   DefaultMountTimeout,
+		multiplex: true,
+		masters:   newControlMasters(filepath.Join(t.TempDir(), "control")),
+	}
+	vol := &sshfsVolume{Name: "vol", MountPoint: t.TempDir(), SSHCmd: "user@host:/data", Password: "secret"}
+	if err := m.Mount(vol); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "ControlPath="+m.masters.dir) {
+		t.Fatalf("Expected sshfs to use the shared master, got %q", output)
+	}
+	m.masters.release(vol)
+
+	vol.Multiplex = "false"
+	if err := m.Mount(vol); err != nil {
+		t.Fatal(err)
+	}
+	if output, _ = ioutil.ReadFile(args); strings.Contains(string(output), "ControlPath") {
+		t.Fatalf("Expected the volume to use a connection of its own, got %q", output)
+	}
+	if m.Status(vol) != nil {
+		t.Fatal("Expected no shared connection for the volume")
+	}
+}
+
+func TestSSHPool(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	newVol := func(name string) *sshfsVolume {
+		return &sshfsVolume{Name: name, SSHCmd: "user@" + host + ":/data", Port: port, Password: "secret", Backend: BackendNative}
+	}
+
+	pool := newSSHPool()
+	first, key, err := pool.acquire(newVol("first"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, secondKey, err := pool.acquire(newVol("second"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || key != secondKey {
+		t.Fatal("Expected the volumes to share the connection")
+	}
+	if status := pool.status(key); status["shared_connection_volumes"] != 2 {
+		t.Fatalf("Expected two users of the connection, got %v", status)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		first.Wait()
+		close(closed)
+	}()
+	pool.release(key, first)
+	select {
+	case <-closed:
+		t.Fatal("Expected the connection to stay open while a volume uses it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pool.release(key, second)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed after the last release")
+	}
+
+	// A discarded connection is replaced on the next acquire
+	failed, key, err := pool.acquire(newVol("first"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.discard(key, failed)
+	replaced, _, err := pool.acquire(newVol("first"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced == failed {
+		t.Fatal("Expected a new connection after the old one was discarded")
+	}
+	pool.release(key, failed)
+	if status := pool.status(key); status["shared_connection_volumes"] != 1 {
+		t.Fatalf("Expected the release of the discarded connection to be ignored, got %v", status)
+	}
+	pool.release(key, replaced)
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Accepted values of the backend option
+const (
+	// BackendExec mounts by executing the sshfs binary
+	BackendExec = "exec"
+	// BackendNative mounts an in-process SFTP backed FUSE filesystem
+	BackendNative = "native"
+)
+
+// nativeOptions are the pass-through options the native backend understands
+var nativeOptions = map[string]bool{
+	"allow_other": true,
+	"reconnect":   true,
+}
+
+func validBackend(val string) bool {
+	return val == BackendExec || val == BackendNative
+}
+
+// nativeMounter serves volumes from in-process SFTP backed FUSE mounts
+type nativeMounter struct {
+	policy  unmountPolicy
+	timeout time.Duration
+	// Whether volumes that don't set the multiplex option
+	// share the ssh connection to their server
+	multiplex bool
+	pool      *sshPool
+	mutex     *sync.Mutex
+	mounts    map[string]*nativeMount
+}
+
+func newNativeMounter(policy unmountPolicy, mountTimeout time.Duration, multiplex bool) *nativeMounter {
+	return &nativeMounter{
+		policy:    policy,
+		timeout:   mountTimeout,
+		multiplex: multiplex,
+		pool:      newSSHPool(),
+		mutex:     &sync.Mutex{},
+		mounts:    make(map[string]*nativeMount),
+	}
+}
+
+func (n *nativeMounter) mount(vol *sshfsVolume) (*nativeMount, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	m, ok := n.mounts[vol.Name]
+	return m, ok
+}
+
+func (n *nativeMounter) Mount(vol *sshfsVolume) error {
+	var pool *sshPool
+	if vol.multiplexed(n.multiplex) {
+		pool = n.pool
+	}
+	m, err := mountNative(vol, vol.mountTimeout(n.timeout), pool)
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.mounts[vol.Name] = m
+	return nil
+}
+
+func (n *nativeMounter) Unmount(vol *sshfsVolume) error {
+	m, ok := n.mount(vol)
+	if !ok {
+		// A stale mount left behind by a previous plugin process
+		return n.policy.unmount(vol.MountPoint)
+	}
+	if err := m.unmount(n.policy); err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.mounts, vol.Name)
+	return nil
+}
+
+func (n *nativeMounter) Detach(vol *sshfsVolume) error {
+	if m, ok := n.mount(vol); ok {
+		m.close()
+		n.mutex.Lock()
+		delete(n.mounts, vol.Name)
+		n.mutex.Unlock()
+	}
+	return detachMount(vol.MountPoint)
+}
+
+func (n *nativeMounter) Check(vol *sshfsVolume) error {
+	m, ok := n.mount(vol)
+	if !ok {
+		return fmt.Errorf("volume %s has no native mount", vol.Name)
+	}
+	return m.check()
+}
+
+func (n *nativeMounter) Status(vol *sshfsVolume) map[string]interface{} {
+	if m, ok := n.mount(vol); ok {
+		return m.status()
+	}
+	return nil
+}
+
+// nativeMount is an in-process SFTP backed FUSE mount of a volume
+type nativeMount struct {
+	vol       *sshfsVolume
+	reconnect bool
+	// Bounds connecting and reconnecting to the server
+	timeout time.Duration
+	// Shares the ssh connection with other mounts, if set
+	pool *sshPool
+
+	mutex *sync.Mutex
+	ssh   *ssh.Client
+	sftp  *sftp.Client
+	root  string
+	// Key of the shared ssh connection in the pool
+	key string
+
+	connectedAt  time.Time
+	reconnects   int64
+	operations   int64
+	errors       int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// mountNative connects to the volume's server and serves its remote path
+// at the volume's mountpoint. The ssh connection is shared through the pool, if set.
+func mountNative(vol *sshfsVolume, timeout time.Duration, pool *sshPool) (*nativeMount, error) {
+	m := &nativeMount{vol: vol, timeout: timeout, pool: pool, mutex: &sync.Mutex{}}
+	allowOther := false
+	for _, option := range vol.Options {
+		switch option {
+		case "allow_other":
+			allowOther = true
+		case "reconnect":
+			m.reconnect = true
+		}
+	}
+
+	// The first connection gets the time that is left for the mount
+	if err := m.connect(time.Until(vol.deadline(timeout))); err != nil {
+		return nil, err
+	}
+	if vol.Ephemeral {
+		// Ephemeral keys are only used for the first connection
+		vol.identityKey = ""
+	}
+
+	root := &sftpNode{mount: m}
+	_, err := fs.Mount(vol.MountPoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther:  allowOther,
+			FsName:      vol.SSHCmd,
+			Name:        "sshfs",
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		m.close()
+		return nil, fmt.Errorf("failed to mount %s at %s (%s)", vol.SSHCmd, vol.MountPoint, err)
+	}
+	return m, nil
+}
+
+// connect establishes the ssh and sftp sessions within the timeout
+// and resolves the remote root
+func (m *nativeMount) connect(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var sshClient *ssh.Client
+	var err error
+	key := ""
+	if m.pool != nil {
+		sshClient, key, err = m.pool.acquire(m.vol, timeout)
+	} else {
+		sshClient, err = m.vol.dialSSH(timeout)
+	}
+	if err != nil {
+		return err
+	}
+	// The connection is dropped if the server stops responding
+	// while the sftp session is set up
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		if m.pool != nil {
+			m.pool.discard(key, sshClient)
+		} else {
+			sshClient.Close()
+		}
+	})
+	defer timer.Stop()
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		m.closeSSH(key, sshClient)
+		return fmt.Errorf("failed to start the sftp session (%s)", err)
+	}
+
+	root, err := m.vol.resolveRemotePath(sftpClient)
+	if err == nil {
+		if m.vol.CreateRemotePath {
+			err = m.vol.ensureRemoteDir(sshClient, sftpClient, root)
+		} else if _, serr := sftpClient.Stat(root); serr != nil {
+			err = fmt.Errorf("failed to access the remote path %s (%s)", root, serr)
+		}
+	}
+	if err != nil {
+		sftpClient.Close()
+		m.closeSSH(key, sshClient)
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ssh, m.sftp, m.root, m.key = sshClient, sftpClient, root, key
+	m.connectedAt = time.Now()
+	return nil
+}
+
+// closeSSH closes the ssh connection, or releases it if it is shared
+func (m *nativeMount) closeSSH(key string, client *ssh.Client) {
+	if m.pool != nil {
+		m.pool.release(key, client)
+		return
+	}
+	client.Close()
+}
+
+// client returns the current sftp session
+func (m *nativeMount) client() *sftp.Client {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.sftp
+}
+
+// redial replaces the sftp session if it is still the failed one,
+// such that concurrent operations only reconnect once
+func (m *nativeMount) redial(failed *sftp.Client) error {
+	m.mutex.Lock()
+	current := m.sftp
+	oldSSH := m.ssh
+	key := m.key
+	m.mutex.Unlock()
+	if current != failed {
+		return nil
+	}
+
+	log.Warningf("Reconnecting the native mount of volume %s", m.vol.Name)
+	current.Close()
+	if m.pool != nil {
+		// The other mounts of the lost connection reconnect as well
+		m.pool.discard(key, oldSSH)
+	} else {
+		oldSSH.Close()
+	}
+	if err := m.connect(m.timeout); err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.reconnects, 1)
+	return nil
+}
+
+// do runs an sftp operation and, if enabled, retries it once on a new
+// session when the connection was lost
+func (m *nativeMount) do(op func(c *sftp.Client) error) error {
+	atomic.AddInt64(&m.operations, 1)
+	c := m.client()
+	err := op(c)
+	if err != nil && m.reconnect && isConnectionLost(err) {
+		if rerr := m.redial(c); rerr != nil {
+			log.Errorf("Failed to reconnect the native mount of volume %s (%s)", m.vol.Name, rerr)
+		} else {
+			err = op(m.client())
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		atomic.AddInt64(&m.errors, 1)
+	}
+	return err
+}
+
+// check verifies that the ssh connection still responds
+func (m *nativeMount) check() error {
+	m.mutex.Lock()
+	client := m.ssh
+	m.mutex.Unlock()
+	if client == nil {
+		return fmt.Errorf("the ssh connection to %s is closed", m.vol.sshAddress())
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return fmt.Errorf("the ssh connection to %s is lost (%s)", m.vol.sshAddress(), err)
+	}
+	return nil
+}
+
+// unmount stops serving the mountpoint and closes the connection
+func (m *nativeMount) unmount(policy unmountPolicy) error {
+	if err := policy.unmount(m.vol.MountPoint); err != nil {
+		return err
+	}
+	// The server stops serving by itself once the kernel ends the session
+	m.close()
+	return nil
+}
+
+func (m *nativeMount) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sftp != nil {
+		m.sftp.Close()
+	}
+	if m.ssh != nil {
+		m.closeSSH(m.key, m.ssh)
+		m.ssh = nil
+	}
+}
+
+// status returns the connection metrics of the mount
+func (m *nativeMount) status() map[string]interface{} {
+	m.mutex.Lock()
+	connectedAt := m.connectedAt
+	key := m.key
+	m.mutex.Unlock()
+	status := map[string]interface{}{
+		"native_connected_since": connectedAt.Format(time.RFC3339Nano),
+		"native_reconnects":      atomic.LoadInt64(&m.reconnects),
+		"native_operations":      atomic.LoadInt64(&m.operations),
+		"native_errors":          atomic.LoadInt64(&m.errors),
+		"native_bytes_read":      atomic.LoadInt64(&m.bytesRead),
+		"native_bytes_written":   atomic.LoadInt64(&m.bytesWritten),
+	}
+	if m.pool != nil {
+		for k, v := range m.pool.status(key) {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+func isConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, io.EOF)
+}
+
+// toErrno converts sftp errors to the errno returned to the kernel
+func toErrno(err error) syscall.Errno {
+	if err == nil {
+		return fs.OK
+	}
+	var errno syscall.Errno
+	var status *sftp.StatusError
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case isConnectionLost(err):
+		return syscall.ENOTCONN
+	case errors.As(err, &status):
+		switch status.FxCode() {
+		case sftp.ErrSSHFxNoSuchFile:
+			return syscall.ENOENT
+		case sftp.ErrSSHFxPermissionDenied:
+			return syscall.EACCES
+		case sftp.ErrSSHFxOpUnsupported:
+			return syscall.ENOTSUP
+		}
+	}
+	return syscall.EIO
+}
+
+// sftpNode is a file, directory or symlink of the remote filesystem
+type sftpNode struct {
+	fs.Inode
+	mount *nativeMount
+}
+
+var (
+	_ fs.NodeGetattrer  = (*sftpNode)(nil)
+	_ fs.NodeSetattrer  = (*sftpNode)(nil)
+	_ fs.NodeLookuper   = (*sftpNode)(nil)
+	_ fs.NodeReaddirer  = (*sftpNode)(nil)
+	_ fs.NodeMkdirer    = (*sftpNode)(nil)
+	_ fs.NodeRmdirer    = (*sftpNode)(nil)
+	_ fs.NodeUnlinker   = (*sftpNode)(nil)
+	_ fs.NodeRenamer    = (*sftpNode)(nil)
+	_ fs.NodeCreater    = (*sftpNode)(nil)
+	_ fs.NodeOpener     = (*sftpNode)(nil)
+	_ fs.NodeSymlinker  = (*sftpNode)(nil)
+	_ fs.NodeReadlinker = (*sftpNode)(nil)
+	_ fs.NodeStatfser   = (*sftpNode)(nil)
+)
+
+// remote returns the path of the node, or its child name, on the server
+func (n *sftpNode) remote(name ...string) string {
+	m := n.mount
+	m.mutex.Lock()
+	root := m.root
+	m.mutex.Unlock()
+	return path.Join(append([]string{root, n.Path(nil)}, name...)...)
+}
+
+func fillAttr(fi os.FileInfo, out *fuse.Attr) {
+	out.Size = uint64(fi.Size())
+	out.Blocks = (out.Size + 511) / 512
+	out.Blksize = 4096
+	out.Nlink = 1
+	mtime := fi.ModTime()
+	out.SetTimes(nil, &mtime, &mtime)
+	if stat, ok := fi.Sys().(*sftp.FileStat); ok {
+		// The sftp mode holds the posix file type and permission bits
+		out.Mode = stat.Mode
+		out.Uid = stat.UID
+		out.Gid = stat.GID
+		atime := time.Unix(int64(stat.Atime), 0)
+		out.SetTimes(&atime, nil, nil)
+	} else {
+		out.Mode = uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			out.Mode |= syscall.S_IFDIR
+		} else {
+			out.Mode |= syscall.S_IFREG
+		}
+	}
+}
+
+func (n *sftpNode) newChild(ctx context.Context, fi os.FileInfo, out *fuse.EntryOut) *fs.Inode {
+	fillAttr(fi, &out.Attr)
+	child := &sftpNode{mount: n.mount}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT})
+}
+
+func (n *sftpNode) lstat(remote string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		fi, err = c.Lstat(remote)
+		return err
+	})
+	return fi, err
+}
+
+func (n *sftpNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fi, err := n.lstat(n.remote())
+	if err != nil {
+		return toErrno(err)
+	}
+	fillAttr(fi, &out.Attr)
+	return fs.OK
+}
+
+func (n *sftpNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	remote := n.remote()
+	err := n.mount.do(func(c *sftp.Client) error {
+		if mode, ok := in.GetMode(); ok {
+			if err := c.Chmod(remote, os.FileMode(mode&07777)); err != nil {
+				return err
+			}
+		}
+		uid, uok := in.GetUID()
+		gid, gok := in.GetGID()
+		if uok || gok {
+			fi, err := c.Lstat(remote)
+			if err != nil {
+				return err
+			}
+			stat := fi.Sys().(*sftp.FileStat)
+			if !uok {
+				uid = stat.UID
+			}
+			if !gok {
+				gid = stat.GID
+			}
+			if err := c.Chown(remote, int(uid), int(gid)); err != nil {
+				return err
+			}
+		}
+		if size, ok := in.GetSize(); ok {
+			if err := c.Truncate(remote, int64(size)); err != nil {
+				return err
+			}
+		}
+		atime, aok := in.GetATime()
+		mtime, mok := in.GetMTime()
+		if aok || mok {
+			now := time.Now()
+			if !aok {
+				atime = now
+			}
+			if !mok {
+				mtime = now
+			}
+			if err := c.Chtimes(remote, atime, mtime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return toErrno(err)
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *sftpNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fi, err := n.lstat(n.remote(name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), fs.OK
+}
+
+func (n *sftpNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	var infos []os.FileInfo
+	remote := n.remote()
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		infos, err = c.ReadDir(remote)
+		return err
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(infos))
+	for _, fi := range infos {
+		var attr fuse.Attr
+		fillAttr(fi, &attr)
+		entries = append(entries, fuse.DirEntry{Name: fi.Name(), Mode: attr.Mode})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *sftpNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	remote := n.remote(name)
+	err := n.mount.do(func(c *sftp.Client) error {
+		if err := c.Mkdir(remote); err != nil {
+			return err
+		}
+		return c.Chmod(remote, os.FileMode(mode&07777))
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	fi, err := n.lstat(remote)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), fs.OK
+}
+
+func (n *sftpNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	remote := n.remote(name)
+	return toErrno(n.mount.do(func(c *sftp.Client) error {
+		return c.RemoveDirectory(remote)
+	}))
+}
+
+func (n *sftpNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	remote := n.remote(name)
+	return toErrno(n.mount.do(func(c *sftp.Client) error {
+		return c.Remove(remote)
+	}))
+}
+
+func (n *sftpNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.ENOTSUP
+	}
+	parent, ok := newParent.(*sftpNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	from, to := n.remote(name), parent.remote(newName)
+	return toErrno(n.mount.do(func(c *sftp.Client) error {
+		// Replace an existing target like rename(2) if the server supports it
+		if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+			return c.PosixRename(from, to)
+		}
+		return c.Rename(from, to)
+	}))
+}
+
+func (n *sftpNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	remote := n.remote(name)
+	var file *sftp.File
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		file, err = c.OpenFile(remote, openFlags(flags)|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		return c.Chmod(remote, os.FileMode(mode&07777))
+	})
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, nil, 0, toErrno(err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), &sftpHandle{mount: n.mount, file: file}, 0, fs.OK
+}
+
+func (n *sftpNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	remote := n.remote()
+	var file *sftp.File
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		file, err = c.OpenFile(remote, openFlags(flags))
+		return err
+	})
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+	return &sftpHandle{mount: n.mount, file: file}, 0, fs.OK
+}
+
+func (n *sftpNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	remote := n.remote(name)
+	err := n.mount.do(func(c *sftp.Client) error {
+		return c.Symlink(target, remote)
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	fi, err := n.lstat(remote)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, fi, out), fs.OK
+}
+
+func (n *sftpNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	remote := n.remote()
+	var target string
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		target, err = c.ReadLink(remote)
+		return err
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return []byte(target), fs.OK
+}
+
+func (n *sftpNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	remote := n.remote()
+	var stat *sftp.StatVFS
+	err := n.mount.do(func(c *sftp.Client) (err error) {
+		stat, err = c.StatVFS(remote)
+		return err
+	})
+	if err != nil {
+		return toErrno(err)
+	}
+	out.Blocks = stat.Blocks
+	out.Bfree = stat.Bfree
+	out.Bavail = stat.Bavail
+	out.Files = stat.Files
+	out.Ffree = stat.Ffree
+	out.Bsize = uint32(stat.Bsize)
+	out.Frsize = uint32(stat.Frsize)
+	out.NameLen = uint32(stat.Namemax)
+	return fs.OK
+}
+
+// openFlags returns the open(2) flags that sftp understands
+func openFlags(flags uint32) int {
+	return int(flags) & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC | os.O_EXCL)
+}
+
+// sftpHandle is an open remote file. Handles are bound to the sftp
+// session they were opened on and fail once it is reconnected.
+type sftpHandle struct {
+	mount *nativeMount
+	file  *sftp.File
+}
+
+var (
+	_ fs.FileReader   = (*sftpHandle)(nil)
+	_ fs.FileWriter   = (*sftpHandle)(nil)
+	_ fs.FileFsyncer  = (*sftpHandle)(nil)
+	_ fs.FileReleaser = (*sftpHandle)(nil)
+)
+
+func (h *sftpHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	atomic.AddInt64(&h.mount.operations, 1)
+	n, err := h.file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		atomic.AddInt64(&h.mount.errors, 1)
+		return nil, toErrno(err)
+	}
+	atomic.AddInt64(&h.mount.bytesRead, int64(n))
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (h *sftpHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	atomic.AddInt64(&h.mount.operations, 1)
+	n, err := h.file.WriteAt(data, off)
+	atomic.AddInt64(&h.mount.bytesWritten, int64(n))
+	if err != nil {
+		atomic.AddInt64(&h.mount.errors, 1)
+		return uint32(n), toErrno(err)
+	}
+	return uint32(n), fs.OK
+}
+
+func (h *sftpHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	// Servers without the fsync extension are not an error
+	if errno := toErrno(h.file.Sync()); errno != syscall.ENOTSUP {
+		return errno
+	}
+	return fs.OK
+}
+
+func (h *sftpHandle) Release(ctx context.Context) syscall.Errno {
+	return toErrno(h.file.Close())
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/sftp"
+)
+
+func TestToErrno(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		errno syscall.Errno
+	}{
+		{nil, fs.OK},
+		{syscall.EPERM, syscall.EPERM},
+		{fmt.Errorf("wrapped (%w)", syscall.ENOSPC), syscall.ENOSPC},
+		{os.ErrNotExist, syscall.ENOENT},
+		{&os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, syscall.EACCES},
+		{os.ErrExist, syscall.EEXIST},
+		{io.EOF, syscall.ENOTCONN},
+		{sftp.ErrSSHFxConnectionLost, syscall.ENOTCONN},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxNoSuchFile)}, syscall.ENOENT},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxPermissionDenied)}, syscall.EACCES},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxOpUnsupported)}, syscall.ENOTSUP},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxFailure)}, syscall.EIO},
+		{fmt.Errorf("unknown"), syscall.EIO},
+	} {
+		if errno := toErrno(test.err); errno != test.errno {
+			t.Errorf("Expected %v for %v, got %v", test.errno, test.err, errno)
+		}
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	flags := uint32(os.O_RDWR | os.O_CREATE | os.O_TRUNC | syscall.O_NONBLOCK | syscall.O_CLOEXEC)
+	if got := openFlags(flags); got != os.O_RDWR|os.O_CREATE|os.O_TRUNC {
+		t.Fatalf("Expected the flags sftp understands, got %o", got)
+	}
+	if got := openFlags(uint32(os.O_WRONLY | os.O_APPEND | os.O_EXCL)); got != os.O_WRONLY|os.O_APPEND|os.O_EXCL {
+		t.Fatalf("Expected the flags to be kept, got %o", got)
+	}
+}
+
+func TestFillAttr(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, make([]byte, 1000), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.Attr
+	fillAttr(fi, &attr)
+	if attr.Mode != syscall.S_IFREG|0640 || attr.Size != 1000 || attr.Blocks != 2 || attr.Nlink != 1 {
+		t.Fatalf("Unexpected attributes of a local file %+v", attr)
+	}
+	if attr.Mtime != uint64(fi.ModTime().Unix()) {
+		t.Fatalf("Expected the modification time, got %d", attr.Mtime)
+	}
+	fi, err = os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillAttr(fi, &attr)
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Fatalf("Expected a directory, got mode %o", attr.Mode)
+	}
+
+	// The sftp attributes carry the file type, owner and access time
+	stat := &sftp.FileStat{Size: 10, Mode: syscall.S_IFLNK | 0777, UID: 1000, GID: 100, Atime: 1000, Mtime: 2000}
+	attr = fuse.Attr{}
+	fillAttr(testFileInfo{name: "link", stat: stat}, &attr)
+	if attr.Mode != syscall.S_IFLNK|0777 || attr.Uid != 1000 || attr.Gid != 100 || attr.Size != 10 {
+		t.Fatalf("Unexpected attributes of a remote symlink %+v", attr)
+	}
+	if attr.Atime != 1000 || attr.Mtime != 2000 {
+		t.Fatalf("Expected the remote times, got %d and %d", attr.Atime, attr.Mtime)
+	}
+}
+
+// testFileInfo is the os.FileInfo of an sftp listing
+type testFileInfo struct {
+	name string
+	stat *sftp.FileStat
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return int64(fi.stat.Size) }
+func (fi testFileInfo) Mode() os.FileMode  { return os.FileMode(fi.stat.Mode & 0777) }
+func (fi testFileInfo) ModTime() time.Time { return time.Unix(int64(fi.stat.Mtime), 0) }
+func (fi testFileInfo) IsDir() bool        { return fi.stat.Mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (fi testFileInfo) Sys() interface{}   { return fi.stat }
+
+// newTestNode connects to an in-process sftp server serving the remote
+// directory, and returns the root node of the filesystem without mounting it
+func newTestNode(t *testing.T, remote string, options ...sftp.ServerOption) *sftpNode {
+	host, port, _ := net.SplitHostPort(testSSHServer(t, "secret", options...))
+	vol := &sshfsVolume{Name: "vol", SSHCmd: "user@" + host + ":" + remote, Port: port, Password: "secret", Backend: BackendNative}
+	m := &nativeMount{vol: vol, timeout: time.Second, mutex: &sync.Mutex{}}
+	if err := m.connect(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.close)
+
+	root := &sftpNode{mount: m}
+	fs.NewNodeFS(root, &fs.Options{})
+	return root
+}
+
+// child returns the node of an inode returned by the parent,
+// after adding it to the tree like the kernel bridge does
+func child(parent *sftpNode, name string, inode *fs.Inode) *sftpNode {
+	parent.AddChild(name, inode, true)
+	return inode.Operations().(*sftpNode)
+}
+
+func TestNativeNodeFiles(t *testing.T) {
+	remote := t.TempDir()
+	root := newTestNode(t, remote)
+	ctx := context.Background()
+
+	var entry fuse.EntryOut
+	inode, handle, _, errno := root.Create(ctx, "file", uint32(os.O_RDWR), 0600, &entry)
+	if errno != fs.OK {
+		t.Fatalf("Failed to create a file: %v", errno)
+	}
+	if entry.Attr.Mode != syscall.S_IFREG|0600 {
+		t.Fatalf("Expected a regular file, got mode %o", entry.Attr.Mode)
+	}
+	file := child(root, "file", inode)
+	if n, errno := handle.(fs.FileWriter).Write(ctx, []byte("hello world"), 0); errno != fs.OK || n != 11 {
+		t.Fatalf("Failed to write the file: %d %v", n, errno)
+	}
+	if errno := handle.(fs.FileFsyncer).Fsync(ctx, 0); errno != fs.OK {
+		t.Fatalf("Failed to sync the file: %v", errno)
+	}
+	if errno := handle.(fs.FileReleaser).Release(ctx); errno != fs.OK {
+		t.Fatalf("Failed to close the file: %v", errno)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(remote, "file")); string(data) != "hello world" {
+		t.Fatalf("Expected the data on the server, got %q", data)
+	}
+
+	handle, _, errno = file.Open(ctx, uint32(os.O_RDONLY))
+	if errno != fs.OK {
+		t.Fatalf("Failed to open the file: %v", errno)
+	}
+	result, errno := handle.(fs.FileReader).Read(ctx, make([]byte, 5), 6)
+	if errno != fs.OK {
+		t.Fatalf("Failed to read the file: %v", errno)
+	}
+	if data, _ := result.Bytes(nil); string(data) != "world" {
+		t.Fatalf("Expected to read from the offset, got %q", data)
+	}
+	handle.(fs.FileReleaser).Release(ctx)
+
+	var attr fuse.AttrOut
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE | fuse.FATTR_SIZE, Mode: 0644, Size: 5}}
+	if errno := file.Setattr(ctx, nil, in, &attr); errno != fs.OK {
+		t.Fatalf("Failed to set the attributes: %v", errno)
+	}
+	if attr.Mode != syscall.S_IFREG|0644 || attr.Size != 5 {
+		t.Fatalf("Expected the new mode and size, got %+v", attr.Attr)
+	}
+	if fi, _ := os.Stat(filepath.Join(remote, "file")); fi.Mode().Perm() != 0644 || fi.Size() != 5 {
+		t.Fatalf("Expected the attributes to be set on the server, got %v", fi)
+	}
+
+	if errno := root.Rename(ctx, "file", root, "renamed", 0); errno != fs.OK {
+		t.Fatalf("Failed to rename the file: %v", errno)
+	}
+	if errno := root.Rename(ctx, "renamed", root, "file", 1); errno != syscall.ENOTSUP {
+		t.Fatalf("Expected rename flags to be unsupported, got %v", errno)
+	}
+	if _, errno := root.Lookup(ctx, "file", &entry); errno != syscall.ENOENT {
+		t.Fatalf("Expected the old name to be gone, got %v", errno)
+	}
+	if _, errno := root.Lookup(ctx, "renamed", &entry); errno != fs.OK || entry.Attr.Size != 5 {
+		t.Fatalf("Expected to find the renamed file, got %v", errno)
+	}
+
+	if errno := root.Unlink(ctx, "renamed"); errno != fs.OK {
+		t.Fatalf("Failed to remove the file: %v", errno)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "renamed")); !os.IsNotExist(err) {
+		t.Fatal("Expected the file to be removed from the server")
+	}
+	if errno := root.Unlink(ctx, "renamed"); errno != syscall.ENOENT {
+		t.Fatalf("Expected a missing file to fail, got %v", errno)
+	}
+}
+
+func TestNativeNodeDirectories(t *testing.T) {
+	remote := t.TempDir()
+	root := newTestNode(t, remote)
+	ctx := context.Background()
+
+	var entry fuse.EntryOut
+	inode, errno := root.Mkdir(ctx, "dir", 0750, &entry)
+	if errno != fs.OK {
+		t.Fatalf("Failed to create a directory: %v", errno)
+	}
+	if entry.Attr.Mode != syscall.S_IFDIR|0750 {
+		t.Fatalf("Expected a directory, got mode %o", entry.Attr.Mode)
+	}
+	dir := child(root, "dir", inode)
+	if _, errno := root.Mkdir(ctx, "dir", 0750, &entry); errno == fs.OK {
+		t.Fatal("Expected an existing directory to fail")
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "dir", "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errno := dir.Symlink(ctx, "file", "link", &entry); errno != fs.OK {
+		t.Fatalf("Failed to create a symlink: %v", errno)
+	}
+	inode, errno = dir.Lookup(ctx, "link", &entry)
+	if errno != fs.OK || entry.Attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Fatalf("Expected to find the symlink, got mode %o and %v", entry.Attr.Mode, errno)
+	}
+	if target, errno := child(dir, "link", inode).Readlink(ctx); errno != fs.OK || string(target) != "file" {
+		t.Fatalf("Expected the link target, got %q and %v", target, errno)
+	}
+
+	stream, errno := dir.Readdir(ctx)
+	if errno != fs.OK {
+		t.Fatalf("Failed to list the directory: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		entry, errno := stream.Next()
+		if errno != fs.OK {
+			t.Fatal(errno)
+		}
+		names = append(names, fmt.Sprintf("%s:%o", entry.Name, entry.Mode&syscall.S_IFMT))
+	}
+	sort.Strings(names)
+	expected := []string{fmt.Sprintf("file:%o", syscall.S_IFREG), fmt.Sprintf("link:%o", syscall.S_IFLNK)}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+
+	var attr fuse.AttrOut
+	if errno := dir.Getattr(ctx, nil, &attr); errno != fs.OK || attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Fatalf("Expected the attributes of the directory, got %v", errno)
+	}
+	var statfs fuse.StatfsOut
+	if errno := root.Statfs(ctx, &statfs); errno != fs.OK || statfs.Blocks == 0 || statfs.Bsize == 0 {
+		t.Fatalf("Expected the statistics of the remote filesystem, got %+v and %v", statfs, errno)
+	}
+
+	if errno := root.Rmdir(ctx, "dir"); errno == fs.OK {
+		t.Fatal("Expected removing a directory that is not empty to fail")
+	}
+	dir.Unlink(ctx, "link")
+	dir.Unlink(ctx, "file")
+	if errno := root.Rmdir(ctx, "dir"); errno != fs.OK {
+		t.Fatalf("Failed to remove the directory: %v", errno)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "dir")); !os.IsNotExist(err) {
+		t.Fatal("Expected the directory to be removed from the server")
+	}
+}
+
+func TestNativeNodeReadOnly(t *testing.T) {
+	remote := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(remote, "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := newTestNode(t, remote, sftp.ReadOnly())
+	ctx := context.Background()
+
+	var entry fuse.EntryOut
+	if _, _, _, errno := root.Create(ctx, "new", uint32(os.O_WRONLY), 0600, &entry); errno != syscall.EACCES {
+		t.Fatalf("Expected creating a file to be denied, got %v", errno)
+	}
+	if errno := root.Unlink(ctx, "file"); errno != syscall.EACCES {
+		t.Fatalf("Expected removing a file to be denied, got %v", errno)
+	}
+	inode, errno := root.Lookup(ctx, "file", &entry)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+	handle, _, errno := child(root, "file", inode).Open(ctx, uint32(os.O_RDONLY))
+	if errno != fs.OK {
+		t.Fatalf("Expected reading to be allowed, got %v", errno)
+	}
+	handle.(fs.FileReleaser).Release(ctx)
+}
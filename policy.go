@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDeniedOptions are pass-through options that execute commands in the
+// plugin or bypass the options that the driver manages itself
+var defaultDeniedOptions = []string{
+	"ssh_command",
+	"sshfs_command",
+	"ssh_protocol",
+	"sftp_server",
+	"directport",
+	"slave",
+	"passive",
+	"ProxyCommand",
+	"ProxyJump",
+	"LocalCommand",
+	"PermitLocalCommand",
+	"KnownHostsCommand",
+	"RemoteCommand",
+	"LocalForward",
+	"RemoteForward",
+	"DynamicForward",
+	"PKCS11Provider",
+	"SecurityKeyProvider",
+	"Include",
+	"IdentityFile",
+	"IdentityAgent",
+	"UserKnownHostsFile",
+	"GlobalKnownHostsFile",
+	"StrictHostKeyChecking",
+	"ControlMaster",
+	"ControlPath",
+	"ControlPersist",
+	"password_stdin",
+}
+
+// optionPolicy decides which sshfs and ssh options volumes may pass through.
+// Option names are compared case-insensitively, like ssh does.
+type optionPolicy struct {
+	// If set, only these options may be passed through
+	Allow []string `json:"allow,omitempty"`
+	// Options that are rejected, defaults to the defaultDeniedOptions
+	Deny []string `json:"deny"`
+	// Options that are passed to every mount, overriding the volume's value.
+	// Flags such as allow_other have an empty value.
+	Force map[string]string `json:"force,omitempty"`
+}
+
+func newOptionPolicy() *optionPolicy {
+	return &optionPolicy{Deny: append([]string{}, defaultDeniedOptions...)}
+}
+
+// splitOptionList splits a comma separated list of option names
+func splitOptionList(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// loadOptionPolicy reads the policy from the JSON file at path, if it exists,
+// and applies the ALLOWED_OPTIONS, DENIED_OPTIONS and FORCED_OPTIONS
+// comma separated lists from the environment on top of it
+func loadOptionPolicy(path string) (*optionPolicy, error) {
+	policy := newOptionPolicy()
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		policy.Deny = nil
+		if err := json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("failed to parse the option policy %s (%s)", path, err)
+		}
+		if policy.Deny == nil {
+			policy.Deny = append([]string{}, defaultDeniedOptions...)
+		}
+		log.Infof("Loaded the option policy %s", path)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the option policy %s (%s)", path, err)
+	}
+
+	if allowed := os.Getenv("ALLOWED_OPTIONS"); allowed != "" {
+		policy.Allow = splitOptionList(allowed)
+	}
+	if denied := os.Getenv("DENIED_OPTIONS"); denied != "" {
+		policy.Deny = append(policy.Deny, splitOptionList(denied)...)
+	}
+	if forced := os.Getenv("FORCED_OPTIONS"); forced != "" {
+		if policy.Force == nil {
+			policy.Force = make(map[string]string)
+		}
+		for _, option := range splitOptionList(forced) {
+			key, val := splitOption(option)
+			policy.Force[key] = val
+		}
+	}
+
+	for key := range policy.Force {
+		if containsFold(policy.Deny, key) {
+			return nil, fmt.Errorf("the option policy both forces and denies '%s'", key)
+		}
+	}
+	return policy, nil
+}
+
+// splitOption splits a key=val option
+func splitOption(option string) (string, string) {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i], option[i+1:]
+	}
+	return option, ""
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error naming the first option the policy rejects.
+// sshfs splits -o arguments on commas, so every comma separated part of an
+// option is checked on its own.
+func (p *optionPolicy) validate(options []string) error {
+	for _, option := range options {
+		for _, part := range strings.Split(option, ",") {
+			key, _ := splitOption(part)
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			if containsFold(p.Deny, key) {
+				return fmt.Errorf("the option '%s' is denied by the plugin's option policy", key)
+			}
+			if len(p.Allow) > 0 && !containsFold(p.Allow, key) && !p.forced(key) {
+				return fmt.Errorf("the option '%s' is not allowed by the plugin's option policy", key)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *optionPolicy) forced(key string) bool {
+	for forcedKey := range p.Force {
+		if strings.EqualFold(forcedKey, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply validates the options and returns them with the forced options
+// replacing any option with the same name
+func (p *optionPolicy) apply(options []string) ([]string, error) {
+	if err := p.validate(options); err != nil {
+		return nil, err
+	}
+
+	applied := make([]string, 0, len(options)+len(p.Force))
+	for _, option := range options {
+		key, _ := splitOption(option)
+		if !p.forced(key) {
+			applied = append(applied, option)
+		}
+	}
+
+	keys := make([]string, 0, len(p.Force))
+	for key := range p.Force {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if val := p.Force[key]; val != "" {
+			applied = append(applied, key+"="+val)
+		} else {
+			applied = append(applied, key)
+		}
+	}
+	return applied, nil
+}
+
+// status describes the policy in the volume status
+func (p *optionPolicy) status() map[string]interface{} {
+	return map[string]interface{}{
+		"allow": p.Allow,
+		"deny":  p.Deny,
+		"force": p.Force,
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestOptionPolicyValidate(t *testing.T) {
+	policy := newOptionPolicy()
+	for _, options := range [][]string{{"allow_other"}, {"Compression=no", "cache=yes"}} {
+		if err := policy.validate(options); err != nil {
+			t.Errorf("Expected %v to be allowed: %s", options, err)
+		}
+	}
+	for _, options := range [][]string{
+		{"ssh_command=touch /tmp/x"},
+		{"proxycommand=nc %h %p"},
+		{"Compression=no,ssh_command=touch /tmp/x"},
+		{"UserKnownHostsFile=/dev/null"},
+	} {
+		if err := policy.validate(options); err == nil {
+			t.Errorf("Expected %v to be denied", options)
+		}
+	}
+
+	policy.Allow = []string{"reconnect", "cache"}
+	if err := policy.validate([]string{"reconnect", "cache=no"}); err != nil {
+		t.Errorf("Expected the allowed options to pass: %s", err)
+	}
+	if err := policy.validate([]string{"allow_other"}); err == nil {
+		t.Error("Expected an option outside the allowlist to be rejected")
+	}
+}
+
+func TestOptionPolicyApply(t *testing.T) {
+	policy := newOptionPolicy()
+	policy.Force = map[string]string{"ServerAliveInterval": "15", "reconnect": ""}
+	options, err := policy.apply([]string{"serveraliveinterval=60", "cache=no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cache=no", "ServerAliveInterval=15", "reconnect"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("Expected %v, got %v", expected, options)
+	}
+}
+
+func TestLoadOptionPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	policy, err := loadOptionPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policy.Deny, defaultDeniedOptions) {
+		t.Fatalf("Expected the default denylist without a policy file, got %v", policy.Deny)
+	}
+
+	data := `{"allow": ["cache"], "force": {"reconnect": ""}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DENIED_OPTIONS", "allow_other, follow_symlinks")
+	t.Setenv("FORCED_OPTIONS", "ServerAliveInterval=15")
+	policy, err = loadOptionPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsFold(policy.Deny, "ssh_command") || !containsFold(policy.Deny, "follow_symlinks") {
+		t.Fatalf("Expected the default and environment denylists, got %v", policy.Deny)
+	}
+	if len(policy.Force) != 2 || policy.Force["ServerAliveInterval"] != "15" {
+		t.Fatalf("Expected the file and environment forced options, got %v", policy.Force)
+	}
+
+	t.Setenv("FORCED_OPTIONS", "allow_other")
+	if _, err := loadOptionPolicy(path); err == nil {
+		t.Fatal("Expected a policy that forces a denied option to be rejected")
+	}
+}
+
+func TestCreateEnforcesOptionPolicy(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	d.policy.Force = map[string]string{"reconnect": ""}
+
+	err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{
+		"sshcmd": "user@host:/data", "password": "secret", "ssh_command": "touch /tmp/x",
+	}})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("Expected the denied option to be rejected, got %v", err)
+	}
+	if _, ok := d.volumes["vol"]; ok {
+		t.Fatal("Expected the rejected volume not to be created")
+	}
+
+	createTestVolume(t, d, "vol", nil)
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, ok := res.Volume.Status["option_policy"].(map[string]interface{})
+	if !ok || !reflect.DeepEqual(status["force"], d.policy.Force) {
+		t.Fatalf("Expected the option policy in the status, got %v", res.Volume.Status)
+	}
+
+	// A volume created under an older policy is checked again on mount
+	d.policy.Deny = append(d.policy.Deny, "cache")
+	d.volumes["vol"].Options = append(d.volumes["vol"].Options, "cache=yes")
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err == nil {
+		t.Fatal("Expected the mount to be rejected by the policy")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// profileSecretOptions are options that carry secrets inline. They are not
+// allowed in profiles, which are kept in cleartext on the state mount.
+var profileSecretOptions = []string{"password", "ssh_key", "id_rsa", "key_passphrase", "jump_password"}
+
+// loadProfiles reads the named connection profiles from the JSON file at path.
+// Every profile maps create options to their default values. A missing file
+// has no profiles.
+func loadProfiles(path string) (map[string]map[string]string, error) {
+	profiles := make(map[string]map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the profiles %s (%s)", path, err)
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse the profiles %s (%s)", path, err)
+	}
+
+	for name, options := range profiles {
+		for _, key := range []string{"profile", "ephemeral"} {
+			if _, ok := options[key]; ok {
+				return nil, fmt.Errorf("the profile '%s' can't set the '%s' option", name, key)
+			}
+		}
+		for _, key := range profileSecretOptions {
+			if _, ok := options[key]; ok {
+				return nil, fmt.Errorf("the profile '%s' can't set the secret '%s' option", name, key)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// profileOptions returns the options of the named profile merged with the
+// volume's own options, which take precedence
+func (d *sshfsDriver) profileOptions(name string, overrides map[string]string) (map[string]string, error) {
+	profiles, err := loadProfiles(d.profilesPath)
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("the profile '%s' does not exist", name)
+	}
+
+	options := make(map[string]string, len(profile)+len(overrides))
+	for key, val := range profile {
+		options[key] = val
+	}
+	for key, val := range overrides {
+		options[key] = val
+	}
+	return options, nil
+}
+
+// profileOverrides returns the options of a create request without the
+// profile and the inline secrets, which are sealed with the volume instead
+func profileOverrides(options map[string]string) map[string]string {
+	overrides := make(map[string]string, len(options))
+	for key, val := range options {
+		if key != "profile" && !containsFold(profileSecretOptions, key) {
+			overrides[key] = val
+		}
+	}
+	return overrides
+}
+
+// resolveProfile returns the volume set up from the current version of its
+// profile, such that changes to the profile are used from the next mount.
+// It reads files, so the caller passes a snapshot and must not hold d.mutex.
+func (d *sshfsDriver) resolveProfile(vol *sshfsVolume) (*sshfsVolume, error) {
+	options, err := d.profileOptions(vol.Profile, vol.ProfileOptions)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to apply the profile of volume %s (%s)", vol.Name, err)
+		log.Error(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	if vol.Password != "" {
+		options["password"] = vol.Password
+	}
+	if vol.identityKey != "" {
+		options["ssh_key"] = vol.identityKey
+	}
+	if vol.keyPassphrase != "" {
+		options["key_passphrase"] = vol.keyPassphrase
+	}
+	if vol.jumpPassword != "" {
+		options["jump_password"] = vol.jumpPassword
+	}
+
+	resolved := &sshfsVolume{Name: vol.Name, MountPoint: vol.MountPoint}
+	if vol.keyShredded() {
+		// The key hook provides the key of the mount, so the shredded
+		// key is neither read again nor required by the options
+		for _, key := range []string{"identity_file", "id_rsa_file", "ssh_key", "id_rsa"} {
+			delete(options, key)
+		}
+		resolved.IdentityFile = vol.IdentityFile
+		resolved.IdentityKeyFile = vol.IdentityKeyFile
+	}
+	if err := resolved.setupOptions(options); err != nil {
+		msg := fmt.Sprintf("Failed to apply the profile of volume %s (%s)", vol.Name, err)
+		log.Error(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	return resolved, nil
+}
+
+// applyProfile updates the volume with the settings of its resolved profile.
+// The volume keeps its identity, runtime state and secrets.
+// The caller must hold d.mutex.
+func applyProfile(vol *sshfsVolume, resolved *sshfsVolume) {
+	updated := *resolved
+	updated.Name = vol.Name
+	updated.MountPoint = vol.MountPoint
+	updated.CreatedAt = vol.CreatedAt
+	updated.Profile = vol.Profile
+	updated.ProfileOptions = vol.ProfileOptions
+
+	updated.RefCount = vol.RefCount
+	updated.MountIDs = vol.MountIDs
+	updated.lock = vol.lock
+	updated.ConnectedAt = vol.ConnectedAt
+	updated.ReconnectCount = vol.ReconnectCount
+	updated.LastError = vol.LastError
+	updated.LastErrorAt = vol.LastErrorAt
+	updated.capacity = vol.capacity
+
+	updated.Password = vol.Password
+	updated.SealedPassword = vol.SealedPassword
+	updated.identityKey = vol.identityKey
+	updated.KeyOption = vol.KeyOption
+	updated.SealedIdentityKey = vol.SealedIdentityKey
+	updated.keyPassphrase = vol.keyPassphrase
+	updated.SealedKeyPassphrase = vol.SealedKeyPassphrase
+	updated.jumpPassword = vol.jumpPassword
+	updated.SealedJumpPassword = vol.SealedJumpPassword
+	updated.KeyShreddedAt = vol.KeyShreddedAt
+	if vol.keyShredded() {
+		// The shredded key can't be read again to describe it
+		updated.KeyType = vol.KeyType
+		updated.KeyFingerprint = vol.KeyFingerprint
+	}
+	*vol = updated
+}
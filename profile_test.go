@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func writeTestProfiles(t *testing.T, d *sshfsDriver, data string) {
+	if err := os.MkdirAll(filepath.Dir(d.profilesPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.profilesPath, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	profiles, err := loadProfiles(d.profilesPath)
+	if err != nil || len(profiles) != 0 {
+		t.Fatalf("Expected no profiles without a file, got %v (%v)", profiles, err)
+	}
+
+	for _, data := range []string{
+		`{"p": {"password": "secret"}}`,
+		`{"p": {"id_rsa": "KEY"}}`,
+		`{"p": {"profile": "other"}}`,
+		`[]`,
+	} {
+		writeTestProfiles(t, d, data)
+		if _, err := loadProfiles(d.profilesPath); err == nil {
+			t.Errorf("Expected the profiles %s to be rejected", data)
+		}
+	}
+}
+
+func TestCreateWithProfile(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	writeTestProfiles(t, d, `{"hpc-storage": {
+		"sshcmd": "user@storage:/data",
+		"port": "2222",
+		"identity_file": "/root/.ssh/id_ed25519",
+		"cache": "yes"
+	}}`)
+
+	if err := d.Create(&volume.CreateRequest{Name: "missing", Options: map[string]string{"profile": "other"}}); err == nil {
+		t.Fatal("Expected an unknown profile to be rejected")
+	}
+
+	createTestVolume(t, d, "vol", map[string]string{
+		"profile":     "hpc-storage",
+		"remote_path": "/data/project",
+		"cache":       "no",
+	})
+	vol := d.volumes["vol"]
+	if vol.SSHCmd != "user@storage:/data/project" || vol.Port != "2222" || vol.IdentityFile != "/root/.ssh/id_ed25519" {
+		t.Fatalf("Expected the profile's connection settings, got %+v", vol)
+	}
+	if !reflect.DeepEqual(vol.Options, []string{"cache=no"}) {
+		t.Fatalf("Expected the volume's options to override the profile's, got %v", vol.Options)
+	}
+
+	// Changes to the profile are used from the next mount
+	writeTestProfiles(t, d, `{"hpc-storage": {
+		"sshcmd": "user@storage2:/data",
+		"identity_file": "/root/.ssh/id_storage2",
+		"mount_timeout": "2m",
+		"reconnect": ""
+	}}`)
+	capacity := &cachedCapacity{at: time.Now()}
+	vol.capacity = capacity
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if vol.SSHCmd != "user@storage2:/data/project" || vol.Port != "" || vol.IdentityFile != "/root/.ssh/id_storage2" || vol.MountTimeout != "2m" {
+		t.Fatalf("Expected the updated profile to be applied, got %+v", vol)
+	}
+	if vol.CreatedAt == "" || len(vol.MountIDs) != 1 || vol.ConnectedAt == "" || vol.Profile != "hpc-storage" || vol.capacity != capacity {
+		t.Fatalf("Expected the volume to keep its runtime state, got %+v", vol)
+	}
+	options := strings.Join(vol.Options, ",")
+	if len(vol.Options) != 2 || !strings.Contains(options, "reconnect") || !strings.Contains(options, "cache=no") {
+		t.Fatalf("Expected the updated profile's options, got %v", vol.Options)
+	}
+}
+
+func TestProfileKeepsInlineSecrets(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	writeTestProfiles(t, d, `{"p": {"sshcmd": "user@host:/data"}}`)
+	createTestVolume(t, d, "vol", map[string]string{"profile": "p", "password": "secret"})
+
+	if _, ok := d.volumes["vol"].ProfileOptions["password"]; ok {
+		t.Fatal("Expected the password not to be kept with the profile options")
+	}
+
+	// The sealed password is used when the profile is applied after a restart
+	d = newTestDriver(t, basePath, newFakeMounter())
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.volumes["vol"].Password != "secret" {
+		t.Fatalf("Expected the password to be kept, got %q", d.volumes["vol"].Password)
+	}
+}
+
+func TestProfileEphemeralKeyHook(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newTestDriver(t, t.TempDir(), mounter)
+	hook := filepath.Join(t.TempDir(), "hook")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"NEW KEY FOR $1\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d.keyHook = hook
+	writeTestProfiles(t, d, `{"p": {"sshcmd": "user@host:/data"}}`)
+	createTestVolume(t, d, "vol", map[string]string{"profile": "p", "ssh_key": testPrivateKey(t, ""), "ephemeral": "true"})
+
+	// The second mount applies the profile after the key has been shredded
+	for _, id := range []string{"a", "b"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mounter.last.identityKey != "NEW KEY FOR vol\n" {
+		t.Fatalf("Expected the provisioned key to be used, got %q", mounter.last.identityKey)
+	}
+}
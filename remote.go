@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// parseRemoteMode parses the octal permissions of the remote_mode option
+func parseRemoteMode(val string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("'remote_mode' must be octal permissions such as 0750, not '%s'", val)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validRemoteGroup accepts a numeric gid or a group name
+func validRemoteGroup(val string) bool {
+	if _, err := strconv.ParseUint(val, 10, 32); err == nil {
+		return true
+	}
+	return remoteGroupPattern.MatchString(val)
+}
+
+// resolveRemotePath returns the absolute remote path of the volume,
+// which is relative to the user's home directory unless it is absolute
+func (v *sshfsVolume) resolveRemotePath(client *sftp.Client) (string, error) {
+	root := v.remotePath()
+	if path.IsAbs(root) {
+		return root, nil
+	}
+	home, err := client.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the remote home directory (%s)", err)
+	}
+	return path.Join(home, root), nil
+}
+
+// createRemotePath connects to the server and creates the volume's remote
+// path if it doesn't exist by the deadline. It is called before sshfs mounts the path.
+func (v *sshfsVolume) createRemotePath(deadline time.Time) error {
+	sshClient, err := v.dialSSHBefore(deadline)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return fmt.Errorf("failed to start the sftp session to create the remote path (%s)", err)
+	}
+	defer sftpClient.Close()
+
+	root, err := v.resolveRemotePath(sftpClient)
+	if err != nil {
+		return err
+	}
+	return v.ensureRemoteDir(sshClient, sftpClient, root)
+}
+
+// ensureRemoteDir creates the remote directory and its parents like mkdir -p.
+// The remote_mode and remote_group only apply to a directory that is created.
+func (v *sshfsVolume) ensureRemoteDir(sshClient *ssh.Client, sftpClient *sftp.Client, root string) error {
+	if fi, err := sftpClient.Stat(root); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("the remote path %s exists but is not a directory", root)
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return v.remotePathError("access", root, err)
+	}
+
+	if err := sftpClient.MkdirAll(root); err != nil {
+		return v.remotePathError("create", root, err)
+	}
+	log.Infof("Created the remote path %s of volume %s", root, v.Name)
+
+	if v.RemoteMode != "" {
+		mode, err := parseRemoteMode(v.RemoteMode)
+		if err != nil {
+			return err
+		}
+		if err := sftpClient.Chmod(root, mode); err != nil {
+			return v.remotePathError("set the mode of", root, err)
+		}
+	}
+	if v.RemoteGroup != "" {
+		if err := v.chgrpRemote(sshClient, sftpClient, root); err != nil {
+			return v.remotePathError("set the group of", root, err)
+		}
+	}
+	return nil
+}
+
+// chgrpRemote changes the group of the remote path. A numeric gid is set
+// over sftp, while a group name is resolved by running chgrp on the server.
+func (v *sshfsVolume) chgrpRemote(sshClient *ssh.Client, sftpClient *sftp.Client, root string) error {
+	if gid, err := strconv.ParseUint(v.RemoteGroup, 10, 32); err == nil {
+		fi, err := sftpClient.Stat(root)
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*sftp.FileStat)
+		if !ok {
+			return fmt.Errorf("the server did not report the owner of %s", root)
+		}
+		return sftpClient.Chown(root, int(stat.UID), int(gid))
+	}
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput("chgrp -- " + shellQuote(v.RemoteGroup) + " " + shellQuote(root))
+	if err != nil {
+		return fmt.Errorf("%s %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// remotePathError explains why the remote path could not be created,
+// calling out missing permissions of the volume's user
+func (v *sshfsVolume) remotePathError(action string, root string, err error) error {
+	var status *sftp.StatusError
+	if errors.Is(err, os.ErrPermission) ||
+		(errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxPermissionDenied) {
+		msg := fmt.Sprintf("Permission denied to %s the remote path %s as %s on %s", action, root, v.sshUser(), v.sshAddress())
+		log.Error(msg)
+		return fmt.Errorf(msg)
+	}
+	msg := fmt.Sprintf("Failed to %s the remote path %s on %s (%s)", action, root, v.sshAddress(), err)
+	log.Error(msg)
+	return fmt.Errorf(msg)
+}
+
+// shellQuote quotes the argument for the server's shell
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
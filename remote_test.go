@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestRemotePathOptions(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{
+		"sshcmd":             "user@host:/data/project",
+		"password":           "pw",
+		"create_remote_path": "true",
+		"remote_mode":        "2770",
+		"remote_group":       "project",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vol.CreateRemotePath || vol.RemoteMode != "2770" || vol.RemoteGroup != "project" {
+		t.Fatalf("Expected the remote path options to be set, got %+v", vol)
+	}
+
+	for _, options := range []map[string]string{
+		{"create_remote_path": "maybe"},
+		{"create_remote_path": "true", "remote_mode": "0999"},
+		{"create_remote_path": "true", "remote_mode": "17777"},
+		{"create_remote_path": "true", "remote_group": "staff;reboot"},
+		{"remote_mode": "0750"},
+		{"remote_group": "1000"},
+	} {
+		options["sshcmd"] = "user@host:/data"
+		options["password"] = "pw"
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		if err := vol.setupOptions(options); err == nil {
+			t.Errorf("Expected the options %v to be rejected", redactOptions(options))
+		}
+	}
+}
+
+func TestCreateRemotePath(t *testing.T) {
+	address := testSSHServer(t, "secret")
+	host, port, _ := net.SplitHostPort(address)
+	remote := filepath.Join(t.TempDir(), "data", "project")
+	vol := &sshfsVolume{
+		Name:             "vol",
+		SSHCmd:           "user@" + host + ":" + remote,
+		Port:             port,
+		Password:         "secret",
+		CreateRemotePath: true,
+		RemoteMode:       "0750",
+		RemoteGroup:      strconv.Itoa(os.Getgid()),
+	}
+	if err := vol.createRemotePath(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Fatalf("Expected a directory with mode 0750, got %s", fi.Mode())
+	}
+	if gid := fi.Sys().(*syscall.Stat_t).Gid; int(gid) != os.Getgid() {
+		t.Fatalf("Expected the group %d, got %d", os.Getgid(), gid)
+	}
+
+	// An existing directory is left as it is
+	if err := os.Chmod(remote, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.createRemotePath(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(remote); fi.Mode().Perm() != 0700 {
+		t.Fatalf("Expected the mode of the existing directory to be kept, got %s", fi.Mode())
+	}
+}
+
+func TestCreateRemotePathDenied(t *testing.T) {
+	address := testSSHServer(t, "secret", sftp.ReadOnly())
+	host, port, _ := net.SplitHostPort(address)
+	vol := &sshfsVolume{
+		Name:             "vol",
+		SSHCmd:           "user@" + host + ":" + filepath.Join(t.TempDir(), "data"),
+		Port:             port,
+		Password:         "secret",
+		CreateRemotePath: true,
+	}
+	err := vol.createRemotePath(time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "Permission denied to create the remote path") {
+		t.Fatalf("Expected a permission error, got %v", err)
+	}
+	if reason := mountFailureReason(err); reason != "remote_path" {
+		t.Fatalf("Expected the remote_path failure reason, got %s", reason)
+	}
+}
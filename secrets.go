@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SecretKeySize is the size in bytes of the key that seals secrets at rest
+	SecretKeySize = 32
+	// sealedAESGCMPrefix marks a secret sealed by the aesGCMStore
+	sealedAESGCMPrefix = "aesgcm:"
+)
+
+// secretStore seals the volume secrets before they are persisted
+// and opens them again when the state is loaded.
+type secretStore interface {
+	Seal(plaintext string) (string, error)
+	Open(sealed string) (string, error)
+}
+
+// aesGCMStore seals secrets with AES-256-GCM
+type aesGCMStore struct {
+	aead cipher.AEAD
+}
+
+func newAESGCMStore(key []byte) (*aesGCMStore, error) {
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("the secret key must be %d bytes, not %d", SecretKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMStore{aead: aead}, nil
+}
+
+func (s *aesGCMStore) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedAESGCMPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *aesGCMStore) Open(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedAESGCMPrefix) {
+		return "", fmt.Errorf("the secret is not sealed with %s", strings.TrimSuffix(sealedAESGCMPrefix, ":"))
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedAESGCMPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return "", fmt.Errorf("the sealed secret is truncated")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the sealed secret, is the secret key correct? (%s)", err)
+	}
+	return string(plaintext), nil
+}
+
+// decodeSecretKey accepts the key either as raw bytes or base64 encoded
+func decodeSecretKey(data []byte) ([]byte, error) {
+	if len(data) == SecretKeySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("the secret key is neither %d raw bytes nor base64 encoded (%s)", SecretKeySize, err)
+	}
+	return key, nil
+}
+
+// errNoSecretKey is returned when a secret has to be sealed or opened
+// but no secret key is configured
+var errNoSecretKey = errors.New("no secret key is configured, set SECRET_KEY or SECRET_KEY_FILE")
+
+// missingSecretStore is the secret store without a secret key.
+// Volumes without secrets are served, while secrets can't be sealed or opened.
+type missingSecretStore struct{}
+
+func (missingSecretStore) Seal(plaintext string) (string, error) {
+	return "", errNoSecretKey
+}
+
+func (missingSecretStore) Open(sealed string) (string, error) {
+	return "", errNoSecretKey
+}
+
+// newSecretStore creates the secret store from the base64 encoded key in
+// SECRET_KEY or the key file at SECRET_KEY_FILE, which must be kept apart
+// from the state that the key protects. Without either, volumes with
+// secrets can't be created.
+func newSecretStore() (secretStore, error) {
+	if encoded := os.Getenv("SECRET_KEY"); encoded != "" {
+		key, err := decodeSecretKey([]byte(encoded))
+		if err != nil {
+			return nil, err
+		}
+		return newAESGCMStore(key)
+	}
+
+	keyFile := os.Getenv("SECRET_KEY_FILE")
+	if keyFile == "" {
+		log.Warning("No secret key is configured, volumes with passwords or keys can't be created. " +
+			"Set SECRET_KEY or SECRET_KEY_FILE to a key that is kept apart from the state")
+		return missingSecretStore{}, nil
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secret key %s (%s)", keyFile, err)
+	}
+
+	key, err := decodeSecretKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return newAESGCMStore(key)
+}
+
+// hasSecrets returns whether the volume has secrets that are sealed in the state
+func (v *sshfsVolume) hasSecrets() bool {
+	return v.Password != "" || v.identityKey != "" || v.keyPassphrase != "" || v.jumpPassword != ""
+}
+
+// checkSecretKey returns an error if the volume has secrets
+// but there is no secret key to seal them with
+func (d *sshfsDriver) checkSecretKey(vol *sshfsVolume) error {
+	if _, missing := d.secrets.(missingSecretStore); missing && vol.hasSecrets() {
+		return fmt.Errorf("volume %s has a password or key, but %s", vol.Name, errNoSecretKey)
+	}
+	return nil
+}
+
+// unopenedSecrets returns whether the volume has sealed secrets
+// that could not be opened when the state was loaded
+func (v *sshfsVolume) unopenedSecrets() bool {
+	return (v.SealedPassword != "" && v.Password == "") ||
+		(v.SealedIdentityKey != "" && v.identityKey == "") ||
+		(v.SealedKeyPassphrase != "" && v.keyPassphrase == "") ||
+		(v.SealedJumpPassword != "" && v.jumpPassword == "")
+}
+
+// sealVolume returns a copy of the volume that is safe to persist,
+// with its secrets sealed and the plaintext secrets cleared. Sealed
+// secrets that could not be opened are kept as they are, and so are the
+// cleartext passwords of older versions while there is no secret key.
+func (d *sshfsDriver) sealVolume(vol *sshfsVolume) (*sshfsVolume, error) {
+	sealed := d.snapshot(vol)
+	sealed.Password = ""
+
+	var err error
+	if sealed.SealedPassword, err = d.sealSecret(vol.Password, vol.SealedPassword); err != nil {
+		if !errors.Is(err, errNoSecretKey) {
+			return nil, err
+		}
+		sealed.Password = vol.Password
+		sealed.SealedPassword = ""
+	}
+	if sealed.SealedIdentityKey, err = d.sealSecret(vol.identityKey, vol.SealedIdentityKey); err != nil {
+		return nil, err
+	}
+	if sealed.SealedKeyPassphrase, err = d.sealSecret(vol.keyPassphrase, vol.SealedKeyPassphrase); err != nil {
+		return nil, err
+	}
+	if sealed.SealedJumpPassword, err = d.sealSecret(vol.jumpPassword, vol.SealedJumpPassword); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// sealSecret seals the plaintext secret, or returns the sealed secret
+// if the plaintext is not known
+func (d *sshfsDriver) sealSecret(plaintext string, sealed string) (string, error) {
+	if plaintext == "" {
+		return sealed, nil
+	}
+	return d.secrets.Seal(plaintext)
+}
+
+// openVolume restores the plaintext secrets of a loaded volume in memory.
+// It returns true if the volume held secrets in cleartext, which are
+// migrated such that they are sealed when the state is saved, and the
+// file that held its cleartext key, which is removed once it is sealed.
+// A volume whose secrets can't be opened without a secret key is flagged
+// and fails to mount, while the other volumes are served.
+func (d *sshfsDriver) openVolume(vol *sshfsVolume) (bool, string, error) {
+	for _, secret := range []struct {
+		name   string
+		sealed string
+		opened *string
+	}{
+		{"password", vol.SealedPassword, &vol.Password},
+		{"private key", vol.SealedIdentityKey, &vol.identityKey},
+		{"key passphrase", vol.SealedKeyPassphrase, &vol.keyPassphrase},
+		{"jump host password", vol.SealedJumpPassword, &vol.jumpPassword},
+	} {
+		if secret.sealed == "" {
+			continue
+		}
+		opened, err := d.secrets.Open(secret.sealed)
+		if errors.Is(err, errNoSecretKey) {
+			vol.flagError(fmt.Sprintf("Failed to open the %s of volume %s (%s)", secret.name, vol.Name, err))
+			continue
+		}
+		if err != nil {
+			return false, "", fmt.Errorf("failed to open the %s of volume %s (%s)", secret.name, vol.Name, err)
+		}
+		*secret.opened = opened
+	}
+
+	if _, missing := d.secrets.(missingSecretStore); missing {
+		// The cleartext secrets of older versions are kept
+		// until there is a key to seal them with
+		if vol.Password != "" && vol.SealedPassword == "" {
+			log.Warningf("The password of volume %s is kept in cleartext, %s", vol.Name, errNoSecretKey)
+		}
+		return false, "", nil
+	}
+
+	migrated := false
+	if vol.Password != "" && vol.SealedPassword == "" {
+		migrated = true
+	}
+
+	// Keys passed with id_rsa used to be kept on disk next to the mountpoint
+	if vol.identityKey == "" && vol.IdentityKeyFile == "" && vol.IdentityFile == vol.keyFile() && !vol.keyShredded() {
+		key, err := ioutil.ReadFile(vol.IdentityFile)
+		if err != nil {
+			// The other volumes are still served, this one fails to mount
+			vol.flagError(fmt.Sprintf("Failed to read the private key of volume %s (%s)", vol.Name, err))
+			return migrated, "", nil
+		}
+		vol.identityKey = string(key)
+		return true, vol.IdentityFile, nil
+	}
+	return migrated, "", nil
+}
+
+// flagError logs the error of a volume that was loaded from the state
+// and records it as the volume's last error
+func (v *sshfsVolume) flagError(msg string) {
+	log.Error(msg)
+	v.LastError = msg
+	v.LastErrorAt = time.Now().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestNewSecretStore(t *testing.T) {
+	t.Setenv("SECRET_KEY", "")
+	t.Setenv("SECRET_KEY_FILE", "")
+	store, err := newSecretStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Seal("secret"); !errors.Is(err, errNoSecretKey) {
+		t.Fatalf("Expected secrets to require a key, got %v", err)
+	}
+
+	key := bytes.Repeat([]byte{0x42}, SecretKeySize)
+	t.Setenv("SECRET_KEY", base64.StdEncoding.EncodeToString(key))
+	if _, err := newSecretStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SECRET_KEY", "")
+	keyFile := filepath.Join(t.TempDir(), "secret.key")
+	if err := ioutil.WriteFile(keyFile, key, VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SECRET_KEY_FILE", keyFile)
+	if _, err := newSecretStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SECRET_KEY_FILE", filepath.Join(t.TempDir(), "missing.key"))
+	if _, err := newSecretStore(); err == nil {
+		t.Fatal("Expected a missing key file to fail")
+	}
+}
+
+func TestCreateWithoutSecretKey(t *testing.T) {
+	basePath := t.TempDir()
+	d := startTestDriver(t, basePath, missingSecretStore{}, newFakeMounter())
+
+	err := d.Create(&volume.CreateRequest{Name: "pw", Options: map[string]string{"sshcmd": "u@h:/p", "password": "pw"}})
+	if err == nil || !strings.Contains(err.Error(), "SECRET_KEY") {
+		t.Fatalf("Expected a volume with a password to require a key, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, "volumes", "pw")); !os.IsNotExist(err) {
+		t.Fatal("Expected the rejected volume to be discarded")
+	}
+
+	createTestVolume(t, d, "key", map[string]string{"sshcmd": "u@h:/p", "identity_file": "/root/.ssh/id_rsa"})
+	if _, err := d.Mount(&volume.MountRequest{Name: "key", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedSecretsWithoutKey(t *testing.T) {
+	basePath := t.TempDir()
+	d := newTestDriver(t, basePath, newFakeMounter())
+	createTestVolume(t, d, "vol", nil)
+
+	d = startTestDriver(t, basePath, missingSecretStore{}, newFakeMounter())
+	if d.volumes["vol"].LastError == "" {
+		t.Fatal("Expected the volume with sealed secrets to be flagged")
+	}
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err == nil {
+		t.Fatal("Expected the volume with sealed secrets to fail to mount")
+	}
+
+	// The sealed secrets survive the state being saved without a key
+	if err := d.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	d = newTestDriver(t, basePath, newFakeMounter())
+	if d.volumes["vol"].Password != "secret" {
+		t.Fatal("Expected the sealed password to be kept")
+	}
+}
+
+func writeLegacyState(t *testing.T, basePath string, state string) {
+	statePath := filepath.Join(basePath, "state", "sshfs-state.json")
+	if err := os.MkdirAll(filepath.Dir(statePath), VolumeDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(statePath, []byte(state), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnreadableLegacyKey(t *testing.T) {
+	basePath := t.TempDir()
+	mountPoint := filepath.Join(basePath, "volumes", "broken")
+	writeLegacyState(t, basePath, `{"broken":{"Name":"broken","MountPoint":"`+mountPoint+
+		`","SSHCmd":"u@h:/p","IdentityFile":"`+mountPoint+`_id_rsa","RefCount":0},`+
+		`"vol":{"Name":"vol","MountPoint":"`+filepath.Join(basePath, "volumes", "vol")+
+		`","SSHCmd":"u@h:/p","Password":"pw","RefCount":0}}`)
+
+	d := newTestDriver(t, basePath, newFakeMounter())
+	if d.volumes["broken"].LastError == "" {
+		t.Fatal("Expected the volume with the missing key to be flagged")
+	}
+	if d.volumes["vol"].Password != "pw" {
+		t.Fatal("Expected the other volumes to be loaded")
+	}
+}
+
+func TestLegacyKeyRemovedOnceSealed(t *testing.T) {
+	basePath := t.TempDir()
+	mountPoint := filepath.Join(basePath, "volumes", "vol")
+	keyFile := mountPoint + "_id_rsa"
+	if err := os.MkdirAll(filepath.Dir(keyFile), VolumeDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte("KEY"), VolumeFileMode); err != nil {
+		t.Fatal(err)
+	}
+	writeLegacyState(t, basePath, `{"vol":{"Name":"vol","MountPoint":"`+mountPoint+
+		`","SSHCmd":"u@h:/p","IdentityFile":"`+keyFile+`","RefCount":0}}`)
+
+	// Without a key, the legacy key file is kept and used as it is
+	startTestDriver(t, basePath, missingSecretStore{}, newFakeMounter())
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Fatal("Expected the key file to be kept without a secret key")
+	}
+
+	d := newTestDriver(t, basePath, newFakeMounter())
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Fatal("Expected the cleartext key file to be removed")
+	}
+	state, err := ioutil.ReadFile(d.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(state, []byte("KEY")) || !bytes.Contains(state, []byte("SealedIdentityKey")) {
+		t.Fatalf("Expected the key to be sealed in the state, got %s", state)
+	}
+}
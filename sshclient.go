@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// splitSSHCmd splits a [user@]host:[path] sshcmd into its components.
+// The host may be an IPv6 address in brackets.
+func splitSSHCmd(cmd string) (user, host, path string) {
+	target := cmd
+	inBrackets := false
+	for i, c := range cmd {
+		if c == '[' {
+			inBrackets = true
+		} else if c == ']' {
+			inBrackets = false
+		} else if c == ':' && !inBrackets {
+			target, path = cmd[:i], cmd[i+1:]
+			break
+		}
+	}
+
+	host = target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, host = target[:i], target[i+1:]
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return user, host, path
+}
+
+// sshUser returns the user that the volume's sshcmd connects as
+func (v *sshfsVolume) sshUser() string {
+	if user, _, _ := splitSSHCmd(v.SSHCmd); user != "" {
+		return user
+	}
+	return "root"
+}
+
+// remotePath returns the path on the server that the volume's sshcmd mounts,
+// which is empty for the user's home directory
+func (v *sshfsVolume) remotePath() string {
+	_, _, path := splitSSHCmd(v.SSHCmd)
+	return path
+}
+
+// sshAuthMethods returns the ssh authentication methods of the volume
+func (v *sshfsVolume) sshAuthMethods() ([]ssh.AuthMethod, error) {
+	password, key, err := v.loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" && v.IdentityFile != "" && v.IdentityFile != v.keyFile() {
+		data, err := ioutil.ReadFile(v.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the identity_file %s (%s)", v.IdentityFile, err)
+		}
+		key = string(data)
+	}
+
+	var methods []ssh.AuthMethod
+	if key != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the private key (%s)", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no credentials to authenticate with")
+	}
+	return methods, nil
+}
+
+// sshHostKeyCallback verifies the server's host key
+// as configured by the volume's host key options
+func (v *sshfsVolume) sshHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if v.HostKeyFingerprint != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != v.HostKeyFingerprint {
+				return fmt.Errorf("host key verification failed for %s, expected %s but the server presented %s",
+					hostname, v.HostKeyFingerprint, fingerprint)
+			}
+			return nil
+		}, nil
+	}
+
+	switch v.StrictHostKeyChecking {
+	case "", StrictHostKeyCheckingNo:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case StrictHostKeyCheckingYes:
+		return knownhosts.New(v.KnownHostsFile)
+	}
+
+	check, err := knownhosts.New(v.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	// accept-new, record the keys of hosts that are not yet known
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		log.Infof("Accepting new host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+		f, ferr := os.OpenFile(v.KnownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, VolumeFileMode)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+		_, ferr = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+		return ferr
+	}, nil
+}
+
+// dialSSH establishes an authenticated ssh connection to the volume's server
+// within the timeout, for a connection that is kept open afterwards
+func (v *sshfsVolume) dialSSH(timeout time.Duration) (*ssh.Client, error) {
+	return v.connectSSH(time.Now().Add(timeout), false)
+}
+
+// dialSSHBefore establishes an authenticated ssh connection to the volume's
+// server for an operation that must be done by the deadline. The connection
+// fails once the deadline has passed, which also bounds the sftp requests.
+func (v *sshfsVolume) dialSSHBefore(deadline time.Time) (*ssh.Client, error) {
+	return v.connectSSH(deadline, true)
+}
+
+func (v *sshfsVolume) connectSSH(deadline time.Time, bounded bool) (*ssh.Client, error) {
+	address := v.sshAddress()
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("failed to connect to %s (timed out)", address)
+	}
+	auth, err := v.sshAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := v.sshHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            v.sshUser(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}
+	if v.HostKeyFingerprint != "" {
+		// Ask for the pinned key, rather than the type the server prefers
+		if _, config.HostKeyAlgorithms, err = v.findPinnedHostKey(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, jumpClient, err := v.dialServer(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// The timer also bounds the handshake with a server that
+	// accepts the connection but never responds
+	timer := time.AfterFunc(time.Until(deadline), func() { conn.Close() })
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil || !bounded || conn.SetDeadline(deadline) == nil {
+		// Connections through a jump host don't support deadlines,
+		// the timer closes them at the deadline instead
+		timer.Stop()
+	}
+	if err != nil {
+		conn.Close()
+		if jumpClient != nil {
+			jumpClient.Close()
+		}
+		return nil, fmt.Errorf("failed to connect to %s (%s)", address, err)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	if jumpClient != nil {
+		go func() {
+			client.Wait()
+			jumpClient.Close()
+		}()
+	}
+	return client, nil
+}
+
+// dialServer opens a connection to the volume's server by the deadline,
+// through its jump host if it has one. The jump client, if any, must be
+// closed along with the connection.
+func (v *sshfsVolume) dialServer(deadline time.Time) (net.Conn, *ssh.Client, error) {
+	address := v.sshAddress()
+	if v.JumpHost == "" {
+		dialer := &net.Dialer{Deadline: deadline}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to %s (%s)", address, err)
+		}
+		return conn, nil, nil
+	}
+
+	jumpClient, err := v.jumpVolume().connectSSH(deadline, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the jump host, %s", err)
+	}
+	// The jump host may never answer the request to open the connection
+	timer := time.AfterFunc(time.Until(deadline), func() { jumpClient.Close() })
+	conn, err := jumpClient.Dial("tcp", address)
+	timer.Stop()
+	if err != nil {
+		jumpClient.Close()
+		return nil, nil, fmt.Errorf("failed to connect to %s (%s)", address, err)
+	}
+	return conn, jumpClient, nil
+}
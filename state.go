@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StateVersion is the version of the state file schema written by the driver.
+// Version 0 is the legacy format, a flat map of volume names to volumes.
+const StateVersion = 1
+
+// BootIDPath holds the kernel's random id of the current boot
+const BootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// driverState is the schema of the persisted state file
+type driverState struct {
+	Version int                     `json:"version"`
+	Volumes map[string]*sshfsVolume `json:"volumes"`
+	// The boot of the host that the state was written in, if known
+	BootID string `json:"boot_id,omitempty"`
+}
+
+// readBootID returns the id of the current boot of the host,
+// or an empty string if it is not known
+func readBootID(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warningf("Failed to read the boot id %s (%s)", path, err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// backupPath returns the path to the backup of the last good state
+func backupPath(statePath string) string {
+	return statePath + ".bak"
+}
+
+// loadState reads the volumes from the state file at path, falling back to
+// the backup of the last good state if the state file is unreadable.
+// A missing state file results in no volumes.
+func loadState(path string) (*driverState, error) {
+	state, err := readStateFile(path)
+	if err == nil {
+		return state, nil
+	}
+	if os.IsNotExist(err) {
+		log.Debugf("No state found at %s", path)
+		return &driverState{Version: StateVersion, Volumes: make(map[string]*sshfsVolume)}, nil
+	}
+
+	log.Errorf("Failed to read the state %s, trying the backup %s (%s)", path, backupPath(path), err)
+	state, berr := readStateFile(backupPath(path))
+	if berr != nil {
+		return nil, fmt.Errorf("failed to read the state %s (%s) and its backup (%s)", path, err, berr)
+	}
+	log.Warningf("Restored %d volumes from the state backup %s", len(state.Volumes), backupPath(path))
+	return state, nil
+}
+
+func readStateFile(path string) (*driverState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(data)
+}
+
+// decodeState parses the state file content of any known schema version
+func decodeState(data []byte) (*driverState, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	// The legacy format has no version, and its
+	// values are volume objects rather than numbers
+	version := 0
+	if raw, ok := fields["version"]; ok && !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("invalid state version %s (%s)", raw, err)
+		}
+	}
+
+	switch version {
+	case 0:
+		volumes := make(map[string]*sshfsVolume)
+		if err := json.Unmarshal(data, &volumes); err != nil {
+			return nil, err
+		}
+		log.Infof("Migrating the state of %d volumes from version 0 to %d", len(volumes), StateVersion)
+		return &driverState{Version: StateVersion, Volumes: volumes}, nil
+	case StateVersion:
+		state := driverState{}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.Volumes == nil {
+			state.Volumes = make(map[string]*sshfsVolume)
+		}
+		return &state, nil
+	}
+	return nil, fmt.Errorf("unsupported state version %d, the newest supported is %d", version, StateVersion)
+}
+
+// writeState atomically replaces the state file at path with the volumes,
+// after keeping the current state file as the backup of the last good state.
+func writeState(path string, volumes map[string]*sshfsVolume, bootID string) error {
+	data, err := json.Marshal(&driverState{Version: StateVersion, Volumes: volumes, BootID: bootID})
+	if err != nil {
+		return err
+	}
+
+	if current, err := ioutil.ReadFile(path); err == nil {
+		if _, err := decodeState(current); err == nil {
+			if err := writeFileAtomic(backupPath(path), current, VolumeFileMode); err != nil {
+				log.Errorf("Failed to back up the state %s (%s)", path, err)
+			}
+		}
+	}
+
+	return writeFileAtomic(path, data, VolumeFileMode)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, flushes it to
+// disk and renames it over path, such that path holds either the old or the new
+// content even if the plugin crashes or the disk fills up during the write.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, VolumeDirMode); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Cleanup in case of failure, a no-op after the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
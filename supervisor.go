@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HealthCheckInterval sets how often a mounted volume is checked
+	HealthCheckInterval = 10 * time.Second
+	// ReconnectMinBackoff sets the initial delay between failed reconnects
+	ReconnectMinBackoff = 1 * time.Second
+	// ReconnectMaxBackoff caps the delay between failed reconnects
+	ReconnectMaxBackoff = 2 * time.Minute
+)
+
+// volumeSupervisor watches the sshfs connection of a single mounted volume
+type volumeSupervisor struct {
+	stop chan struct{}
+	// Closed once the supervisor has returned
+	done chan struct{}
+}
+
+// startSupervisor starts watching the volume, if it isn't already watched.
+// The caller must hold d.mutex.
+func (d *sshfsDriver) startSupervisor(vol *sshfsVolume) {
+	if _, ok := d.supervisors[vol.Name]; ok {
+		return
+	}
+	s := &volumeSupervisor{stop: make(chan struct{}), done: make(chan struct{})}
+	d.supervisors[vol.Name] = s
+	go d.supervise(vol.Name, s)
+}
+
+// stopSupervisor stops watching the volume.
+// The caller must hold d.mutex.
+func (d *sshfsDriver) stopSupervisor(vol *sshfsVolume) {
+	if s, ok := d.supervisors[vol.Name]; ok {
+		close(s.stop)
+		delete(d.supervisors, vol.Name)
+	}
+}
+
+func (d *sshfsDriver) supervise(name string, s *volumeSupervisor) {
+	defer close(s.done)
+	log.Debugf("Starting health supervisor for volume %s", name)
+	wait := d.healthCheckInterval
+	backoff := d.reconnectMinBackoff
+	for {
+		select {
+		case <-s.stop:
+			log.Debugf("Stopping health supervisor for volume %s", name)
+			return
+		case <-time.After(wait):
+		}
+
+		d.mutex.RLock()
+		check := d.healthCheck(name)
+		d.mutex.RUnlock()
+		if check == nil {
+			return
+		}
+
+		// The check is done without holding the driver lock
+		// since a dead endpoint might take a while to respond
+		healthErr := check()
+		if healthErr == nil {
+			wait = d.healthCheckInterval
+			backoff = d.reconnectMinBackoff
+			continue
+		}
+
+		// The volume lock keeps the volume from being unmounted while
+		// reconnecting, other volumes are not blocked
+		vol, ok := d.lockVolume(name)
+		if !ok {
+			return
+		}
+		d.mutex.RLock()
+		inUse := len(vol.MountIDs) > 0
+		d.mutex.RUnlock()
+		select {
+		case <-s.stop:
+			inUse = false
+		default:
+		}
+		if !inUse {
+			vol.lock.Unlock()
+			return
+		}
+
+		log.Warningf("Volume %s is unhealthy, reconnecting (%s)", name, healthErr)
+		err := d.reconnectVolume(vol)
+		d.mutex.Lock()
+		vol.ReconnectCount++
+		if err != nil {
+			reconnectsTotal.WithLabelValues("error").Inc()
+			log.Errorf("Failed to reconnect volume %s, retrying in %s (%s)", name, backoff, err)
+			vol.LastError = err.Error()
+			vol.LastErrorAt = time.Now().Format(time.RFC3339Nano)
+			wait = backoff
+			backoff *= 2
+			if backoff > d.reconnectMaxBackoff {
+				backoff = d.reconnectMaxBackoff
+			}
+		} else {
+			reconnectsTotal.WithLabelValues("success").Inc()
+			log.Infof("Reconnected volume %s", name)
+			vol.LastError = healthErr.Error()
+			vol.LastErrorAt = time.Now().Format(time.RFC3339Nano)
+			wait = d.healthCheckInterval
+			backoff = d.reconnectMinBackoff
+		}
+		d.mutex.Unlock()
+		vol.lock.Unlock()
+		d.saveState()
+	}
+}
+
+// healthCheck returns the check of the volume's connection,
+// or nil if the volume is no longer in use.
+// The caller must hold d.mutex.
+func (d *sshfsDriver) healthCheck(name string) func() error {
+	vol, ok := d.volumes[name]
+	if !ok || len(vol.MountIDs) == 0 {
+		return nil
+	}
+	mount := d.snapshot(vol)
+	return func() error { return d.mounter.Check(mount) }
+}
+
+// reconnectVolume lazily detaches the dead mount and mounts the volume again.
+// The caller must hold vol.lock.
+func (d *sshfsDriver) reconnectVolume(vol *sshfsVolume) error {
+	d.mutex.RLock()
+	mount := d.snapshot(vol)
+	d.mutex.RUnlock()
+
+	if err := d.mounter.Detach(mount); err != nil {
+		return err
+	}
+	return d.mountVolume(vol)
+}
+
+// findSshfsProcess returns the pid of the sshfs process that serves mountPoint
+func findSshfsProcess(mountPoint string) (int, error) {
+	procs, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0, err
+	}
+	for _, proc := range procs {
+		cmdline, err := ioutil.ReadFile(proc)
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+		if filepath.Base(string(args[0])) != "sshfs" {
+			continue
+		}
+		for _, arg := range args[1:] {
+			if string(arg) == mountPoint {
+				return strconv.Atoi(filepath.Base(filepath.Dir(proc)))
+			}
+		}
+	}
+	return 0, fmt.Errorf("no sshfs process found for %s", mountPoint)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// newSupervisedDriver returns a driver whose supervisors check the
+// volumes and back off on a millisecond scale. The supervisors are
+// stopped before the test's directories are removed.
+func newSupervisedDriver(t *testing.T, mounter *fakeMounter) *sshfsDriver {
+	d := newTestDriver(t, t.TempDir(), mounter)
+	d.healthCheckInterval = 10 * time.Millisecond
+	d.reconnectMinBackoff = 20 * time.Millisecond
+	d.reconnectMaxBackoff = 40 * time.Millisecond
+	t.Cleanup(func() {
+		var stopped []*volumeSupervisor
+		d.mutex.Lock()
+		for _, vol := range d.volumes {
+			if s, ok := d.supervisors[vol.Name]; ok {
+				stopped = append(stopped, s)
+				d.stopSupervisor(vol)
+			}
+		}
+		d.mutex.Unlock()
+		for _, s := range stopped {
+			<-s.done
+		}
+	})
+	return d
+}
+
+// waitFor polls the condition until it holds, or fails the test
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func reconnectCount(d *sshfsDriver, name string) int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.volumes[name].ReconnectCount
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newSupervisedDriver(t, mounter)
+	createTestVolume(t, d, "vol", nil)
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection dies behind the driver's back
+	mounter.Detach(d.volumes["vol"])
+	waitFor(t, "the reconnect", func() bool { return reconnectCount(d, "vol") == 1 })
+	if !mounter.isMounted("vol") {
+		t.Fatal("Expected the volume to be mounted again")
+	}
+
+	d.mutex.RLock()
+	lastError := d.volumes["vol"].LastError
+	d.mutex.RUnlock()
+	if !strings.Contains(lastError, "not mounted") {
+		t.Fatalf("Expected the failed check as the last error, got %q", lastError)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newSupervisedDriver(t, mounter)
+	createTestVolume(t, d, "vol", nil)
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter.mutex.Lock()
+	mounter.mountErr = fmt.Errorf("server unreachable")
+	mounter.mutex.Unlock()
+	start := time.Now()
+	mounter.Detach(d.volumes["vol"])
+
+	// The check after 10ms fails, and the reconnects are retried after 20ms and 40ms
+	waitFor(t, "three reconnects", func() bool { return reconnectCount(d, "vol") >= 3 })
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("Expected the reconnects to back off, three took %s", elapsed)
+	}
+	d.mutex.RLock()
+	lastError := d.volumes["vol"].LastError
+	d.mutex.RUnlock()
+	if lastError != "server unreachable" {
+		t.Fatalf("Expected the reconnect error as the last error, got %q", lastError)
+	}
+
+	// Once the server is back the volume is reconnected
+	mounter.mutex.Lock()
+	mounter.mountErr = nil
+	mounter.mutex.Unlock()
+	waitFor(t, "the volume to be mounted", func() bool { return mounter.isMounted("vol") })
+}
+
+func TestSupervisorStopsOnUnmount(t *testing.T) {
+	mounter := newFakeMounter()
+	d := newSupervisedDriver(t, mounter)
+	createTestVolume(t, d, "vol", nil)
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mutex.RLock()
+	_, supervised := d.supervisors["vol"]
+	d.mutex.RUnlock()
+	if supervised {
+		t.Fatal("Expected the supervisor to be stopped")
+	}
+
+	// The unmounted volume is not reconnected
+	time.Sleep(100 * time.Millisecond)
+	if mounter.isMounted("vol") || reconnectCount(d, "vol") != 0 {
+		t.Fatal("Expected the unmounted volume not to be reconnected")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMountTimeout sets how long mounting a volume may take before it is aborted
+	DefaultMountTimeout = 30 * time.Second
+	// DefaultConnectTimeout sets how long ssh waits for the server to accept the connection
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultServerAliveInterval sets how often ssh checks that the server still responds
+	DefaultServerAliveInterval = 15 * time.Second
+	// DefaultServerAliveCountMax sets how many checks may go unanswered
+	// before ssh drops the connection to the server
+	DefaultServerAliveCountMax = 3
+)
+
+// mountTimeoutFromEnv reads the MOUNT_TIMEOUT duration, such as "1m",
+// falling back to the default when it is unset
+func mountTimeoutFromEnv() (time.Duration, error) {
+	raw := os.Getenv("MOUNT_TIMEOUT")
+	if raw == "" {
+		return DefaultMountTimeout, nil
+	}
+	return parseMountTimeout(raw)
+}
+
+func parseMountTimeout(raw string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid mount timeout '%s', it must be a positive duration such as 30s", raw)
+	}
+	return timeout, nil
+}
+
+// mountTimeout returns the volume's mount timeout, or fallback if it has none
+func (v *sshfsVolume) mountTimeout(fallback time.Duration) time.Duration {
+	if v.MountTimeout == "" {
+		return fallback
+	}
+	timeout, err := parseMountTimeout(v.MountTimeout)
+	if err != nil {
+		return fallback
+	}
+	return timeout
+}
+
+// deadline returns when mounting the volume must be done by, which the
+// driver sets once for all the steps of the mount. Without it the volume's
+// mount timeout, or fallback if it has none, starts now.
+func (v *sshfsVolume) deadline(fallback time.Duration) time.Time {
+	if !v.mountDeadline.IsZero() {
+		return v.mountDeadline
+	}
+	return time.Now().Add(v.mountTimeout(fallback))
+}
+
+// defaultSSHOptions returns the keepalive and connect timeout options
+// that the volume's options don't set themselves
+func defaultSSHOptions(options []string, timeout time.Duration) []string {
+	connectTimeout := DefaultConnectTimeout
+	if timeout < connectTimeout {
+		connectTimeout = timeout
+	}
+	defaults := []string{
+		fmt.Sprintf("ConnectTimeout=%d", int((connectTimeout+time.Second-1)/time.Second)),
+		fmt.Sprintf("ServerAliveInterval=%d", int(DefaultServerAliveInterval/time.Second)),
+		fmt.Sprintf("ServerAliveCountMax=%d", DefaultServerAliveCountMax),
+	}
+
+	var missing []string
+	for _, option := range defaults {
+		key, _ := splitOption(option)
+		set := false
+		for _, volOption := range options {
+			for _, part := range strings.Split(volOption, ",") {
+				if volKey, _ := splitOption(part); strings.EqualFold(strings.TrimSpace(volKey), key) {
+					set = true
+				}
+			}
+		}
+		if !set {
+			missing = append(missing, option)
+		}
+	}
+	return missing
+}
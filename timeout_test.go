@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDefaultSSHOptions(t *testing.T) {
+	options := defaultSSHOptions(nil, time.Minute)
+	expected := []string{"ConnectTimeout=10", "ServerAliveInterval=15", "ServerAliveCountMax=3"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("Expected %v, got %v", expected, options)
+	}
+
+	options = defaultSSHOptions([]string{"serveraliveinterval=60", "cache=no,ServerAliveCountMax=5"}, 1500*time.Millisecond)
+	if !reflect.DeepEqual(options, []string{"ConnectTimeout=2"}) {
+		t.Fatalf("Expected only the connect timeout bounded by the mount timeout, got %v", options)
+	}
+}
+
+func TestMountTimeoutOption(t *testing.T) {
+	vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+	err := vol.setupOptions(map[string]string{"sshcmd": "u@h:/p", "password": "pw", "mount_timeout": "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.mountTimeout(DefaultMountTimeout) != 5*time.Second {
+		t.Fatalf("Expected the volume's mount timeout, got %s", vol.mountTimeout(DefaultMountTimeout))
+	}
+
+	for _, timeout := range []string{"0s", "-1s", "soon"} {
+		vol := &sshfsVolume{Name: "vol", MountPoint: filepath.Join(t.TempDir(), "vol")}
+		if err := vol.setupOptions(map[string]string{"sshcmd": "u@h:/p", "password": "pw", "mount_timeout": timeout}); err == nil {
+			t.Errorf("Expected the mount timeout %q to be rejected", timeout)
+		}
+	}
+
+	t.Setenv("MOUNT_TIMEOUT", "")
+	if timeout, err := mountTimeoutFromEnv(); err != nil || timeout != DefaultMountTimeout {
+		t.Fatalf("Expected the default mount timeout, got %s (%v)", timeout, err)
+	}
+	t.Setenv("MOUNT_TIMEOUT", "never")
+	if _, err := mountTimeoutFromEnv(); err == nil {
+		t.Fatal("Expected an invalid MOUNT_TIMEOUT to be rejected")
+	}
+}
+
+func TestExecMountTimeout(t *testing.T) {
+	// An sshfs that hangs like it would on an unresponsive server
+	bin := t.TempDir()
+	script := "#!/bin/sh\nsleep 30 &\nwait\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "sshfs"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	vol := &sshfsVolume{
+		Name:         "vol",
+		MountPoint:   t.TempDir(),
+		SSHCmd:       "user@host:/data",
+		Password:     "secret",
+		MountTimeout: "200ms",
+	}
+	m := &execMounter{policy: defaultUnmountPolicy, timeout: DefaultMountTimeout}
+
+	start := time.Now()
+	err := m.Mount(vol)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the mount to be aborted, it took %s", elapsed)
+	}
+}
+
+func TestMountDeadline(t *testing.T) {
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	createTestVolume(t, d, "vol", map[string]string{"sshcmd": "u@h:/p", "password": "pw", "mount_timeout": "5s"})
+
+	start := time.Now()
+	if _, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := d.mounter.(*fakeMounter).last.mountDeadline
+	if deadline.Before(start.Add(5*time.Second)) || deadline.After(time.Now().Add(5*time.Second)) {
+		t.Fatalf("Expected the mount deadline to follow the volume's mount timeout, got %s", deadline)
+	}
+}
+
+func TestPinnedHostKeyDeadline(t *testing.T) {
+	// A server that accepts connections but never responds
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "sshfs"), []byte("#!/bin/sh\nexit 0\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	vol := &sshfsVolume{
+		Name:               "vol",
+		MountPoint:         t.TempDir(),
+		SSHCmd:             "user@" + host + ":/data",
+		Port:               port,
+		Password:           "secret",
+		KnownHostsFile:     filepath.Join(t.TempDir(), "known_hosts"),
+		HostKeyFingerprint: "SHA256:AAAA",
+		CreateRemotePath:   true,
+		mountDeadline:      time.Now().Add(300 * time.Millisecond),
+	}
+	m := &execMounter{policy: defaultUnmountPolicy, timeout: DefaultMountTimeout}
+
+	start := time.Now()
+	if err := m.Mount(vol); err == nil {
+		t.Fatal("Expected the mount to fail")
+	}
+	// Every host key type and the remote path share the mount's deadline
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the mount to end at its deadline, it took %s", elapsed)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultUnmountTimeout sets how long a busy mount is retried before it is lazily detached
+	DefaultUnmountTimeout = 10 * time.Second
+	// DefaultUnmountRetryInterval sets the delay between unmount attempts of a busy mount
+	DefaultUnmountRetryInterval = 500 * time.Millisecond
+	// ProcessExitGrace sets how long a process may take to exit before it is signalled
+	ProcessExitGrace = 1 * time.Second
+)
+
+// unmountPolicy controls how mountpoints are released
+type unmountPolicy struct {
+	// How long a busy mount is retried before it is lazily detached
+	Timeout time.Duration
+	// The delay between attempts
+	RetryInterval time.Duration
+}
+
+var defaultUnmountPolicy = unmountPolicy{
+	Timeout:       DefaultUnmountTimeout,
+	RetryInterval: DefaultUnmountRetryInterval,
+}
+
+// unmountPolicyFromEnv reads the UNMOUNT_TIMEOUT and UNMOUNT_RETRY_INTERVAL
+// durations, such as "30s", falling back to the defaults when they are unset
+func unmountPolicyFromEnv() (unmountPolicy, error) {
+	policy := defaultUnmountPolicy
+	for env, value := range map[string]*time.Duration{
+		"UNMOUNT_TIMEOUT":        &policy.Timeout,
+		"UNMOUNT_RETRY_INTERVAL": &policy.RetryInterval,
+	} {
+		if raw := os.Getenv(env); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 {
+				return policy, fmt.Errorf("invalid %s duration '%s'", env, raw)
+			}
+			*value = parsed
+		}
+	}
+	if policy.RetryInterval <= 0 {
+		policy.RetryInterval = DefaultUnmountRetryInterval
+	}
+	return policy, nil
+}
+
+// unmount unmounts mountPoint, retrying while it is busy and
+// lazily detaching it once the policy's timeout is exceeded.
+// It is a no-op if mountPoint isn't mounted.
+func (p unmountPolicy) unmount(mountPoint string) error {
+	deadline := time.Now().Add(p.Timeout)
+	for attempt := 1; ; attempt++ {
+		err := syscall.Unmount(mountPoint, 0)
+		switch err {
+		case nil, syscall.EINVAL:
+			return nil
+		case syscall.EBUSY:
+		default:
+			return fmt.Errorf("failed to unmount %s (%s)", mountPoint, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			log.Warningf("%s is still busy after %d unmount attempts, detaching it lazily", mountPoint, attempt)
+			return detachMount(mountPoint)
+		}
+		log.Debugf("%s is busy, retrying the unmount in %s", mountPoint, p.RetryInterval)
+		time.Sleep(p.RetryInterval)
+	}
+}
+
+// detachMount lazily unmounts mountPoint, which is a no-op if it isn't mounted
+func detachMount(mountPoint string) error {
+	if err := syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("lazy unmount of %s failed (%s)", mountPoint, err)
+	}
+	return nil
+}
+
+// processExited returns true once pid no longer exists
+func processExited(pid int) bool {
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+// waitProcessExit polls until pid has exited or the timeout is exceeded
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !processExited(pid) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// terminateProcess makes sure that pid exits, which an sshfs process does by
+// itself after a regular unmount but not after its mount has been detached.
+// It is asked to terminate and killed if it doesn't within the timeout.
+func terminateProcess(pid int, timeout time.Duration) error {
+	if waitProcessExit(pid, ProcessExitGrace) {
+		return nil
+	}
+
+	log.Debugf("Terminating the orphaned sshfs process %d", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	if waitProcessExit(pid, timeout) {
+		return nil
+	}
+
+	log.Warningf("Killing the sshfs process %d which didn't terminate within %s", pid, timeout)
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to kill process %s (%s)", strconv.Itoa(pid), err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnmountPolicyFromEnv(t *testing.T) {
+	t.Setenv("UNMOUNT_TIMEOUT", "")
+	t.Setenv("UNMOUNT_RETRY_INTERVAL", "")
+	policy, err := unmountPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != defaultUnmountPolicy {
+		t.Fatalf("Expected the default policy, got %+v", policy)
+	}
+
+	t.Setenv("UNMOUNT_TIMEOUT", "1m")
+	t.Setenv("UNMOUNT_RETRY_INTERVAL", "2s")
+	policy, err = unmountPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Timeout != time.Minute || policy.RetryInterval != 2*time.Second {
+		t.Fatalf("Expected the configured policy, got %+v", policy)
+	}
+
+	t.Setenv("UNMOUNT_TIMEOUT", "soon")
+	if _, err := unmountPolicyFromEnv(); err == nil {
+		t.Fatal("Expected an invalid duration to fail")
+	}
+}
+
+// mountTmpfs mounts a tmpfs at a new directory, skipping the test
+// where mounting isn't permitted
+func mountTmpfs(t *testing.T) string {
+	mountPoint, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", mountPoint, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Mounting a tmpfs isn't permitted (%s)", err)
+	}
+	t.Cleanup(func() { detachMount(mountPoint) })
+	return mountPoint
+}
+
+func isMounted(t *testing.T, mountPoint string) bool {
+	mounts, err := readMountInfo(MountInfoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mounted := mounts[mountPoint]
+	return mounted
+}
+
+// openBusy keeps a file open in mountPoint, which makes it busy
+func openBusy(t *testing.T, mountPoint string) *os.File {
+	f, err := os.Create(filepath.Join(mountPoint, "busy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestUnmount(t *testing.T) {
+	policy := unmountPolicy{Timeout: time.Second, RetryInterval: 10 * time.Millisecond}
+	mountPoint := mountTmpfs(t)
+	if err := policy.unmount(mountPoint); err != nil {
+		t.Fatal(err)
+	}
+	if isMounted(t, mountPoint) {
+		t.Fatal("Expected the mount to be unmounted")
+	}
+
+	// Unmounting again is a no-op
+	if err := policy.unmount(mountPoint); err != nil {
+		t.Fatalf("Expected unmounting an unmounted path to succeed, got %v", err)
+	}
+	if err := policy.unmount(filepath.Join(mountPoint, "missing")); err == nil {
+		t.Fatal("Expected unmounting a missing path to fail")
+	}
+}
+
+func TestUnmountRetriesBusyMount(t *testing.T) {
+	policy := unmountPolicy{Timeout: 5 * time.Second, RetryInterval: 10 * time.Millisecond}
+	mountPoint := mountTmpfs(t)
+	busy := openBusy(t, mountPoint)
+	time.AfterFunc(100*time.Millisecond, func() { busy.Close() })
+
+	start := time.Now()
+	if err := policy.unmount(mountPoint); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 4*time.Second {
+		t.Fatalf("Expected the unmount to be retried until the mount was released, took %s", elapsed)
+	}
+	if isMounted(t, mountPoint) {
+		t.Fatal("Expected the mount to be unmounted")
+	}
+}
+
+func TestUnmountDetachesBusyMount(t *testing.T) {
+	policy := unmountPolicy{Timeout: 100 * time.Millisecond, RetryInterval: 10 * time.Millisecond}
+	mountPoint := mountTmpfs(t)
+	busy := openBusy(t, mountPoint)
+
+	if err := policy.unmount(mountPoint); err != nil {
+		t.Fatal(err)
+	}
+	if isMounted(t, mountPoint) {
+		t.Fatal("Expected the busy mount to be detached")
+	}
+	// Open files keep working after a lazy unmount
+	if _, err := busy.WriteString("data"); err != nil {
+		t.Fatalf("Expected the open file to stay usable, got %v", err)
+	}
+}
+
+// startProcess starts a shell command and reaps it once it exits,
+// such that it doesn't linger as a zombie
+func startProcess(t *testing.T, command string) (int, chan error) {
+	cmd := exec.Command("sh", "-c", command)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	return cmd.Process.Pid, exited
+}
+
+func exitSignal(t *testing.T, exited chan error) syscall.Signal {
+	select {
+	case err := <-exited:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0
+		}
+		return exitErr.Sys().(syscall.WaitStatus).Signal()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the process to have exited")
+	}
+	return 0
+}
+
+func TestTerminateExitedProcess(t *testing.T) {
+	pid, exited := startProcess(t, "exit 0")
+	if err := terminateProcess(pid, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if signal := exitSignal(t, exited); signal != 0 {
+		t.Fatalf("Expected the process to exit by itself, got %s", signal)
+	}
+}
+
+func TestTerminateProcess(t *testing.T) {
+	pid, exited := startProcess(t, "exec sleep 60")
+	if err := terminateProcess(pid, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if signal := exitSignal(t, exited); signal != syscall.SIGTERM {
+		t.Fatalf("Expected the process to be terminated, got %s", signal)
+	}
+}
+
+func TestKillProcess(t *testing.T) {
+	// The process ignores SIGTERM
+	pid, exited := startProcess(t, "trap '' TERM; exec sleep 60")
+	start := time.Now()
+	if err := terminateProcess(pid, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if signal := exitSignal(t, exited); signal != syscall.SIGKILL {
+		t.Fatalf("Expected the process to be killed, got %s", signal)
+	}
+	if elapsed := time.Since(start); elapsed < ProcessExitGrace+200*time.Millisecond {
+		t.Fatalf("Expected the process to be given time to terminate, took %s", elapsed)
+	}
+}
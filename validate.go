@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxVolumeNameLength bounds volume names, which become directory names
+const MaxVolumeNameLength = 255
+
+var (
+	// volumeNamePattern is the grammar Docker uses for local volume names
+	volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	// sshUserPattern accepts the user names that ssh passes on unquoted
+	sshUserPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.@-]*$`)
+	// sshHostPattern accepts host names and IPv4 addresses
+	sshHostPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+	// remoteGroupPattern accepts the group names of the remote_group option
+	remoteGroupPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+)
+
+// sshTarget is the parsed form of an sshcmd
+type sshTarget struct {
+	User string
+	Host string
+	Port string
+	Path string
+}
+
+// String returns the target in the [user@]host:[path] form that sshfs accepts
+func (t sshTarget) String() string {
+	host := t.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if t.User != "" {
+		host = t.User + "@" + host
+	}
+	return host + ":" + t.Path
+}
+
+// validateVolumeName checks that the name is safe to use as a directory
+// name under the volume path
+func validateVolumeName(name string) error {
+	if len(name) > MaxVolumeNameLength {
+		return fmt.Errorf("volume name '%s' is longer than %d characters", name, MaxVolumeNameLength)
+	}
+	if !volumeNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return fmt.Errorf("volume name '%s' is invalid, it must start with a letter or digit "+
+			"and only contain letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// validatePort checks that port is a TCP port number
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("'port' must be a number between 1 and 65535, not '%s'", port)
+	}
+	return nil
+}
+
+// parseSSHCmd parses and validates an sshcmd in either the [user@]host:[path]
+// form, where an IPv6 host is written in brackets, or the
+// ssh://[user@]host[:port][/path] form, where /~/path is relative to the home directory
+func parseSSHCmd(cmd string) (sshTarget, error) {
+	var target sshTarget
+	if cmd == "" {
+		return target, fmt.Errorf("'sshcmd' option required")
+	}
+	if strings.HasPrefix(cmd, "-") {
+		return target, fmt.Errorf("'sshcmd' must not start with '-'")
+	}
+	for _, c := range cmd {
+		if c < ' ' || c == 0x7f {
+			return target, fmt.Errorf("'sshcmd' must not contain control characters")
+		}
+	}
+
+	if strings.HasPrefix(cmd, "ssh://") {
+		u, err := url.Parse(cmd)
+		if err != nil {
+			return target, fmt.Errorf("'sshcmd' %s is not a valid ssh:// url (%s)", cmd, err)
+		}
+		if _, ok := u.User.Password(); ok {
+			return target, fmt.Errorf("'sshcmd' must not contain a password, use the 'password' option")
+		}
+		target.User = u.User.Username()
+		target.Host = u.Hostname()
+		target.Port = u.Port()
+		// Paths below /~ are relative to the user's home directory
+		switch {
+		case u.Path == "" || u.Path == "/~":
+			target.Path = ""
+		case strings.HasPrefix(u.Path, "/~/"):
+			target.Path = strings.TrimPrefix(u.Path, "/~/")
+		default:
+			target.Path = u.Path
+		}
+	} else {
+		if !strings.Contains(cmd, ":") {
+			return target, fmt.Errorf("'sshcmd' %s must be of the form [user@]host:[path]", cmd)
+		}
+		target.User, target.Host, target.Path = splitSSHCmd(cmd)
+		if strings.HasPrefix(target.Path, ":") {
+			return target, fmt.Errorf("'sshcmd' %s must write an IPv6 address in brackets, e.g. user@[::1]:path", cmd)
+		}
+	}
+
+	if target.User != "" && !sshUserPattern.MatchString(target.User) {
+		return target, fmt.Errorf("'sshcmd' user '%s' is invalid", target.User)
+	}
+	if target.Host == "" {
+		return target, fmt.Errorf("'sshcmd' %s has no host", cmd)
+	}
+	if ip := net.ParseIP(target.Host); ip == nil && !sshHostPattern.MatchString(target.Host) {
+		return target, fmt.Errorf("'sshcmd' host '%s' is invalid", target.Host)
+	}
+	if target.Port != "" {
+		if err := validatePort(target.Port); err != nil {
+			return target, fmt.Errorf("'sshcmd' %s", err)
+		}
+	}
+	if strings.HasPrefix(target.Path, "-") {
+		return target, fmt.Errorf("'sshcmd' path must not start with '-'")
+	}
+	return target, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestValidateVolumeName(t *testing.T) {
+	for _, name := range []string{"vol", "my-vol_1.data", "0"} {
+		if err := validateVolumeName(name); err != nil {
+			t.Errorf("Expected %q to be valid: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "../state", "a/b", ".hidden", "-o", "a..b", "with space", strings.Repeat("a", 256)} {
+		if err := validateVolumeName(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestParseSSHCmd(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		target sshTarget
+		sshcmd string
+	}{
+		{"user@host:/data", sshTarget{User: "user", Host: "host", Path: "/data"}, "user@host:/data"},
+		{"host:", sshTarget{Host: "host"}, "host:"},
+		{"user@[fe80::1]:data", sshTarget{User: "user", Host: "fe80::1", Path: "data"}, "user@[fe80::1]:data"},
+		{"ssh://user@host:2222/data", sshTarget{User: "user", Host: "host", Port: "2222", Path: "/data"}, "user@host:/data"},
+		{"ssh://user@[::1]/~/data", sshTarget{User: "user", Host: "::1", Path: "data"}, "user@[::1]:data"},
+		{"ssh://host", sshTarget{Host: "host"}, "host:"},
+	}
+	for _, test := range tests {
+		target, err := parseSSHCmd(test.cmd)
+		if err != nil {
+			t.Errorf("parseSSHCmd(%q) failed: %s", test.cmd, err)
+			continue
+		}
+		if target != test.target {
+			t.Errorf("parseSSHCmd(%q) = %+v, want %+v", test.cmd, target, test.target)
+		}
+		if target.String() != test.sshcmd {
+			t.Errorf("parseSSHCmd(%q).String() = %q, want %q", test.cmd, target.String(), test.sshcmd)
+		}
+	}
+
+	for _, cmd := range []string{
+		"",
+		"-oProxyCommand=touch /tmp/x",
+		"host",
+		"user@:path",
+		"-user@host:path",
+		"user@-host:path",
+		"user@host:-path",
+		"user@fe80::1:path",
+		"ssh://user:pw@host/path",
+		"ssh://host:99999/path",
+		"user@host:/data\n-o",
+	} {
+		if _, err := parseSSHCmd(cmd); err == nil {
+			t.Errorf("Expected parseSSHCmd(%q) to fail", cmd)
+		}
+	}
+}
+
+func TestCreateRejectsUnsafeInput(t *testing.T) {
+	d := newTestDriver(t, t.TempDir(), newFakeMounter())
+	options := map[string]string{"sshcmd": "user@host:/data", "password": "secret"}
+	if err := d.Create(&volume.CreateRequest{Name: "../state", Options: options}); err == nil {
+		t.Fatal("Expected a path traversing volume name to be rejected")
+	}
+
+	options["port"] = "22; rm"
+	if err := d.Create(&volume.CreateRequest{Name: "vol", Options: options}); err == nil {
+		t.Fatal("Expected an invalid port to be rejected")
+	}
+
+	options["port"] = "22"
+	options["sshcmd"] = "ssh://user@host:2222/data"
+	if err := d.Create(&volume.CreateRequest{Name: "vol", Options: options}); err == nil {
+		t.Fatal("Expected conflicting ports to be rejected")
+	}
+	if len(d.volumes) != 0 {
+		t.Fatalf("Expected no volumes to be created, got %v", d.volumes)
+	}
+}